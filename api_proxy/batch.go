@@ -0,0 +1,143 @@
+package api_proxy
+
+import (
+	"bst_web/utilities"
+	"bytes"
+	"encoding/json"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"net/http"
+	"sync"
+)
+
+// BatchRequest is the accepted body of a batch request.
+type BatchRequest struct {
+	Requests []BatchItem `json:"requests"`
+}
+
+// BatchItem is a single sub-request of a batch. Path is relative to the api,
+// e.g. /ddr/songs/scores?id=abc, and Body is sent as json.
+type BatchItem struct {
+	Id     string          `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// BatchResponse holds one result per sub-request, in request order.
+type BatchResponse struct {
+	Responses []BatchItemResponse `json:"responses"`
+}
+
+// BatchItemResponse is the status and body a sub-request was answered with.
+type BatchItemResponse struct {
+	Id     string          `json:"id,omitempty"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// batchResponseWriter buffers the response of a sub-request.
+type batchResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *batchResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// BatchPost returns a handler executing the sub-requests of a batch against
+// router, which serves the api below prefix. Sub-requests carry the cookies
+// and client address of the batch request and a context derived from it, so
+// they are subject to the same authentication and rate limits as if sent
+// individually. Eagate logins and logouts may not be batched.
+func BatchPost(router http.Handler, prefix string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		_, err := utilities.TokenForRequest(r)
+		if !err.Equals(bst_models.ErrorOK) {
+			utilities.RenderError(rw, r, err)
+			return
+		}
+
+		batch := BatchRequest{}
+		fields := decodeJsonBody(rw, r, maxBatchBodySize, &batch)
+		if len(fields) == 0 {
+			fields = ValidateBatchRequest(batch)
+		}
+		if len(fields) > 0 {
+			writeValidationError(rw, bst_models.ErrorBadBody, fields)
+			return
+		}
+
+		response := BatchResponse{
+			Responses: make([]BatchItemResponse, len(batch.Requests)),
+		}
+		slots := make(chan struct{}, utilities.BatchConcurrency)
+		var wg sync.WaitGroup
+		for i, item := range batch.Requests {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(i int, item BatchItem) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				response.Responses[i] = serveBatchItem(router, prefix, r, item)
+			}(i, item)
+		}
+		wg.Wait()
+
+		bytes, _ := json.Marshal(response)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(bytes)
+	}
+}
+
+func serveBatchItem(router http.Handler, prefix string, parent *http.Request, item BatchItem) (response BatchItemResponse) {
+	response.Id = item.Id
+
+	req, e := http.NewRequest(item.Method, prefix+item.Path, bytes.NewReader(item.Body))
+	if e != nil {
+		response.Status = bst_models.ErrorCreateRequest.CorrespondingHttpCode
+		response.Body, _ = json.Marshal(bst_models.ErrorCreateRequest)
+		return
+	}
+	// each sub-request loads its own session, sharing the registry of the
+	// parent between goroutines is not safe
+	req = req.WithContext(utilities.SubRequestContext(parent))
+	req.RemoteAddr = parent.RemoteAddr
+	req.Host = parent.Host
+	for _, cookie := range parent.Cookies() {
+		req.AddCookie(cookie)
+	}
+	if len(item.Body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rw := &batchResponseWriter{header: make(http.Header)}
+	router.ServeHTTP(rw, req)
+
+	response.Status = rw.status
+	if response.Status == 0 {
+		response.Status = http.StatusOK
+	}
+	body := rw.body.Bytes()
+	if json.Valid(body) {
+		response.Body = body
+	} else if len(body) > 0 {
+		response.Body, _ = json.Marshal(string(body))
+	}
+	return
+}
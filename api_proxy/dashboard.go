@@ -0,0 +1,174 @@
+package api_proxy
+
+import (
+	"bst_web/utilities"
+	"context"
+	"encoding/json"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"net/http"
+	"strings"
+)
+
+// dashboardSection loads one part of the dashboard. Sections run
+// concurrently and share the deadline of ctx.
+type dashboardSection func(ctx context.Context, token string, sub string) (body []byte, staleAge int, err bst_models.Error)
+
+var (
+	dashboardSections = map[string]dashboardSection{
+		"user":        dashboardUser,
+		"ddr_profile": dashboardCached(ddrProfileCache, fetchDdrProfile),
+		"ddr_stats":   dashboardCached(ddrStatsCache, fetchDdrStats),
+		"status":      dashboardStatus,
+	}
+	dashboardSectionNames = []string{"user", "ddr_profile", "ddr_stats", "status"}
+)
+
+// DashboardResponse is the composite document of the dashboard endpoint.
+// Sections that failed are absent from Sections and reported in Errors;
+// sections served from last-known-good data list their age in Stale.
+type DashboardResponse struct {
+	Sections map[string]json.RawMessage  `json:"sections"`
+	Errors   map[string]bst_models.Error `json:"errors,omitempty"`
+	Stale    map[string]int              `json:"stale,omitempty"`
+}
+
+type dashboardResult struct {
+	name     string
+	body     []byte
+	staleAge int
+	err      bst_models.Error
+}
+
+// DashboardGet loads the sections requested in the comma separated sections
+// query parameter, or all of them, concurrently within the dashboard
+// deadline. A failing section does not fail the others.
+func DashboardGet(rw http.ResponseWriter, r *http.Request) {
+	names, fields := parseDashboardSections(r.URL.Query().Get("sections"))
+	if len(fields) > 0 {
+		writeValidationError(rw, bst_models.ErrorBadQuery, fields)
+		return
+	}
+
+	token, err := utilities.TokenForRequest(r)
+	if !err.Equals(bst_models.ErrorOK) {
+		utilities.RenderError(rw, r, err)
+		return
+	}
+
+	response := DashboardGetImpl(r.Context(), token, utilities.SubForRequest(r), names)
+	body, e := json.Marshal(response)
+	if e != nil {
+		utilities.RenderError(rw, r, bst_models.ErrorJsonEncode)
+		return
+	}
+	if len(response.Stale) > 0 {
+		rw.Header().Set(staleHeader, "true")
+	}
+	writeCachedResponse(rw, r, utilities.NewCachedResponse(body))
+}
+
+// DashboardGetImpl runs the named sections concurrently. Sections still
+// running when the deadline passes are reported with ErrorDeadline.
+func DashboardGetImpl(ctx context.Context, token string, sub string, names []string) (response DashboardResponse) {
+	ctx, cancel := context.WithTimeout(ctx, utilities.DashboardTimeout)
+	defer cancel()
+
+	response.Sections = make(map[string]json.RawMessage)
+	response.Errors = make(map[string]bst_models.Error)
+	response.Stale = make(map[string]int)
+
+	// buffered so sections finishing after the deadline do not block
+	results := make(chan dashboardResult, len(names))
+	for _, name := range names {
+		go func(name string, section dashboardSection) {
+			body, staleAge, err := section(ctx, token, sub)
+			results <- dashboardResult{name, body, staleAge, err}
+		}(name, dashboardSections[name])
+	}
+
+	pending := make(map[string]bool)
+	for _, name := range names {
+		pending[name] = true
+	}
+	for len(pending) > 0 {
+		select {
+		case result := <-results:
+			delete(pending, result.name)
+			if !result.err.Equals(bst_models.ErrorOK) {
+				response.Errors[result.name] = result.err
+				continue
+			}
+			// an invalid section would fail encoding the whole document
+			if !json.Valid(result.body) {
+				response.Errors[result.name] = bst_models.ErrorJsonDecode
+				continue
+			}
+			response.Sections[result.name] = result.body
+			if result.staleAge >= 0 {
+				response.Stale[result.name] = result.staleAge
+			}
+		case <-ctx.Done():
+			for name := range pending {
+				response.Errors[name] = utilities.ErrorDeadline
+			}
+			return
+		}
+	}
+	return
+}
+
+func parseDashboardSections(query string) (names []string, fields []FieldError) {
+	if len(query) == 0 {
+		return dashboardSectionNames, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(query, ",") {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			continue
+		}
+		fields = validateOneOf(fields, "sections", name, dashboardSectionNames)
+		seen[name] = true
+		names = append(names, name)
+	}
+	return
+}
+
+func dashboardUser(ctx context.Context, token string, sub string) ([]byte, int, bst_models.Error) {
+	if len(sub) == 0 {
+		return nil, -1, bst_models.ErrorJwtProfile
+	}
+	userCache, ok := UserCacheFor(ctx, sub)
+	if !ok {
+		return nil, -1, bst_models.ErrorNoUserCache
+	}
+	body, e := json.Marshal(userCache)
+	if e != nil {
+		return nil, -1, bst_models.ErrorJsonEncode
+	}
+	return body, -1, bst_models.ErrorOK
+}
+
+func dashboardStatus(ctx context.Context, token string, sub string) ([]byte, int, bst_models.Error) {
+	body, e := json.Marshal(CurrentStatus(ctx))
+	if e != nil {
+		return nil, -1, bst_models.ErrorJsonEncode
+	}
+	return body, -1, bst_models.ErrorOK
+}
+
+// dashboardCached serves a section through the same per-user cache as its
+// standalone endpoint. A staleAge of -1 means the data is fresh.
+func dashboardCached(cacheName string, fetch responseFetcher) dashboardSection {
+	return func(ctx context.Context, token string, sub string) ([]byte, int, bst_models.Error) {
+		result := cachedFetch(ctx, token, sub, cacheName, fetch)
+		if !result.Err.Equals(bst_models.ErrorOK) {
+			return nil, -1, result.Err
+		}
+		if result.Stale {
+			return result.Response.Body, result.StaleAge, bst_models.ErrorOK
+		}
+		return result.Response.Body, -1, bst_models.ErrorOK
+	}
+}
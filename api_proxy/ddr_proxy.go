@@ -2,6 +2,7 @@ package api_proxy
 
 import (
 	"bst_web/utilities"
+	"context"
 	"encoding/json"
 	"fmt"
 	bst_models "github.com/chris-sg/bst_server_models"
@@ -9,11 +10,10 @@ import (
 	"github.com/urfave/negroni"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 )
 
 func CreateDdrProxy(prefix string) *mux.Router {
-	ddrProxy := mux.NewRouter().PathPrefix(prefix + "/ddr").Subrouter()
+	ddrProxy := utilities.HandleRouterErrors(mux.NewRouter().PathPrefix(prefix + "/ddr").Subrouter())
 
 	ddrProxy.Path("/profile/update").Handler(negroni.New(
 		negroni.Wrap(http.HandlerFunc(DdrUpdatePatch)))).Methods(http.MethodPatch)
@@ -34,13 +34,15 @@ func CreateDdrProxy(prefix string) *mux.Router {
 func DdrUpdatePatch(rw http.ResponseWriter, r *http.Request) {
 	token, err := utilities.TokenForRequest(r)
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
 
-	err = DdrUpdatePatchImpl(token)
+	err = DdrUpdatePatchImpl(r.Context(), token)
+	utilities.Audit(r, utilities.AuditProfileUpdate, utilities.AuditOutcome(err), "ddr")
+	if err.Equals(bst_models.ErrorOK) {
+		evictResponseCaches(r, ddrStatsCache, ddrProfileCache)
+	}
 
 	bytes, _ := json.Marshal(err)
 	if !err.Equals(bst_models.ErrorOK) {
@@ -52,8 +54,8 @@ func DdrUpdatePatch(rw http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func DdrUpdatePatchImpl(token string) (err bst_models.Error) {
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "ddr/profile/update")
+func DdrUpdatePatchImpl(ctx context.Context, token string) (err bst_models.Error) {
+	uri := utilities.BstApiUrl("ddr/profile/update")
 
 	req := &http.Request{
 		Method:           http.MethodPatch,
@@ -62,7 +64,7 @@ func DdrUpdatePatchImpl(token string) (err bst_models.Error) {
 	}
 	req.Header.Add("Authorization", "Bearer " + token)
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorApiInaccessible
 		return
@@ -74,7 +76,7 @@ func DdrUpdatePatchImpl(token string) (err bst_models.Error) {
 		err = bst_models.ErrorApiInaccessible
 		return
 	}
-	json.Unmarshal(body, &err)
+	err = upstreamError(res.StatusCode, body)
 
 	return
 }
@@ -82,13 +84,15 @@ func DdrUpdatePatchImpl(token string) (err bst_models.Error) {
 func DdrRefreshPatch(rw http.ResponseWriter, r *http.Request) {
 	token, err := utilities.TokenForRequest(r)
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
 
-	err = DdrRefreshPatchImpl(token)
+	err = DdrRefreshPatchImpl(r.Context(), token)
+	utilities.Audit(r, utilities.AuditProfileRefresh, utilities.AuditOutcome(err), "ddr")
+	if err.Equals(bst_models.ErrorOK) {
+		evictResponseCaches(r, ddrStatsCache, ddrProfileCache)
+	}
 
 	bytes, _ := json.Marshal(err)
 	if !err.Equals(bst_models.ErrorOK) {
@@ -100,8 +104,8 @@ func DdrRefreshPatch(rw http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func DdrRefreshPatchImpl(token string) (err bst_models.Error) {
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "ddr/profile/refresh")
+func DdrRefreshPatchImpl(ctx context.Context, token string) (err bst_models.Error) {
+	uri := utilities.BstApiUrl("ddr/profile/refresh")
 
 	req := &http.Request{
 		Method:           http.MethodPatch,
@@ -110,7 +114,7 @@ func DdrRefreshPatchImpl(token string) (err bst_models.Error) {
 	}
 	req.Header.Add("Authorization", "Bearer " + token)
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -122,35 +126,22 @@ func DdrRefreshPatchImpl(token string) (err bst_models.Error) {
 		err = bst_models.ErrorClientResponse
 		return
 	}
-	json.Unmarshal(body, &err)
+	err = upstreamError(res.StatusCode, body)
 
 	return
 }
 
 func DdrStatsGet(rw http.ResponseWriter, r *http.Request) {
-	token, err := utilities.TokenForRequest(r)
-	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
-		return
-	}
-
-	stats, err := DdrStatsGetImpl(token)
-	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
-		return
-	}
+	serveCachedResponse(rw, r, ddrStatsCache, fetchDdrStats)
+}
 
-	rw.Write([]byte(stats))
-	rw.WriteHeader(http.StatusOK)
-	return
+func fetchDdrStats(ctx context.Context, token string) ([]byte, bst_models.Error) {
+	stats, err := DdrStatsGetImpl(ctx, token)
+	return []byte(stats), err
 }
 
-func DdrStatsGetImpl(token string) (stats string, err bst_models.Error) {
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "ddr/songs/scores/extended")
+func DdrStatsGetImpl(ctx context.Context, token string) (stats string, err bst_models.Error) {
+	uri := utilities.BstApiUrl("ddr/songs/scores/extended")
 
 	req := &http.Request{
 		Method:           http.MethodGet,
@@ -159,7 +150,7 @@ func DdrStatsGetImpl(token string) (stats string, err bst_models.Error) {
 	}
 	req.Header.Add("Authorization", "Bearer " + token)
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -173,7 +164,7 @@ func DdrStatsGetImpl(token string) (stats string, err bst_models.Error) {
 	}
 
 	if res.StatusCode != http.StatusOK {
-		json.Unmarshal(body, &err)
+		err = upstreamError(res.StatusCode, body)
 		return
 	}
 
@@ -182,36 +173,20 @@ func DdrStatsGetImpl(token string) (stats string, err bst_models.Error) {
 }
 
 func DdrProfileGet(rw http.ResponseWriter, r *http.Request) {
-	token, err := utilities.TokenForRequest(r)
-	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
-		return
-	}
+	serveCachedResponse(rw, r, ddrProfileCache, fetchDdrProfile)
+}
 
-	stats, err := DdrProfileGetImpl(token)
-	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
-		return
+func fetchDdrProfile(ctx context.Context, token string) ([]byte, bst_models.Error) {
+	profile, err := DdrProfileGetImpl(ctx, token)
+	if err.Equals(bst_models.ErrorOK) && len(profile) == 0 {
+		err = bst_models.ErrorDdrStats
 	}
-	if len(stats) == 0 {
-		bytes, _ := json.Marshal(bst_models.ErrorDdrStats)
-		rw.WriteHeader(bst_models.ErrorDdrStats.CorrespondingHttpCode)
-		rw.Write(bytes)
-		return
-	}
-
-	rw.WriteHeader(http.StatusOK)
-	rw.Write([]byte(stats))
-	return
+	return []byte(profile), err
 }
 
-func DdrProfileGetImpl(token string) (profile string, err bst_models.Error) {
+func DdrProfileGetImpl(ctx context.Context, token string) (profile string, err bst_models.Error) {
 	err = bst_models.ErrorOK
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "ddr/profile")
+	uri := utilities.BstApiUrl("ddr/profile")
 
 	req := &http.Request{
 		Method:           http.MethodGet,
@@ -220,7 +195,7 @@ func DdrProfileGetImpl(token string) (profile string, err bst_models.Error) {
 	}
 	req.Header.Add("Authorization", "Bearer " + token)
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -234,7 +209,7 @@ func DdrProfileGetImpl(token string) (profile string, err bst_models.Error) {
 	}
 
 	if res.StatusCode != http.StatusOK {
-		json.Unmarshal(body, &err)
+		err = upstreamError(res.StatusCode, body)
 		return
 	}
 
@@ -242,24 +217,22 @@ func DdrProfileGetImpl(token string) (profile string, err bst_models.Error) {
 	return
 }
 
-// TODO: query string instead of body
 func DdrSongScoresGet(rw http.ResponseWriter, r *http.Request) {
 	token, err := utilities.TokenForRequest(r)
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
 
-	buf := make([]byte, 0)
-	r.Body.Read(buf)
+	query, fields := ParseSongScoresQuery(r.URL.RawQuery)
+	if len(fields) > 0 {
+		writeValidationError(rw, bst_models.ErrorBadQuery, fields)
+		return
+	}
 
-	response, err := DdrSongScoresGetImpl(token, r.URL.RawQuery)
+	response, err := DdrSongScoresGetImpl(r.Context(), token, query.Encode())
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
 
@@ -268,8 +241,8 @@ func DdrSongScoresGet(rw http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func DdrSongScoresGetImpl(token string, queryParams string) (response string, err bst_models.Error) {
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "ddr/song/scores")
+func DdrSongScoresGetImpl(ctx context.Context, token string, queryParams string) (response string, err bst_models.Error) {
+	uri := utilities.BstApiUrl("ddr/song/scores")
 	uri.RawQuery = queryParams
 
 	req := &http.Request{
@@ -279,7 +252,7 @@ func DdrSongScoresGetImpl(token string, queryParams string) (response string, er
 	}
 	req.Header.Add("Authorization", "Bearer " + token)
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -293,7 +266,7 @@ func DdrSongScoresGetImpl(token string, queryParams string) (response string, er
 	}
 
 	if res.StatusCode != http.StatusOK {
-		json.Unmarshal(body, &err)
+		err = upstreamError(res.StatusCode, body)
 		return
 	}
 
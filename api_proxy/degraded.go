@@ -0,0 +1,143 @@
+package api_proxy
+
+import (
+	"bst_web/utilities"
+	"encoding/json"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"github.com/golang/glog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	staleHeader    = "X-Bst-Stale"
+	staleAgeHeader = "X-Bst-Stale-Age"
+)
+
+// degradedState tracks whether the BST API is currently failing and whether
+// last-known-good data has been served because of it.
+type degradedState struct {
+	sync.Mutex
+	since       time.Time
+	staleServed int
+}
+
+var (
+	degraded degradedState
+)
+
+func (d *degradedState) upstreamFailed() {
+	d.Lock()
+	defer d.Unlock()
+	if d.since.IsZero() {
+		d.since = time.Now()
+		glog.Warning("bst api failing, entering degraded mode")
+	}
+}
+
+func (d *degradedState) upstreamRecovered() {
+	d.Lock()
+	defer d.Unlock()
+	if !d.since.IsZero() {
+		glog.Infof("bst api recovered after %s, %d stale responses served", time.Since(d.since), d.staleServed)
+	}
+	d.since = time.Time{}
+	d.staleServed = 0
+}
+
+func (d *degradedState) servedStale() {
+	d.Lock()
+	defer d.Unlock()
+	d.staleServed++
+}
+
+func (d *degradedState) status() (since time.Time, staleServed int) {
+	d.Lock()
+	defer d.Unlock()
+	return d.since, d.staleServed
+}
+
+// isUpstreamFailure reports whether err indicates the BST API itself is
+// unavailable, as opposed to rejecting the request.
+func isUpstreamFailure(err bst_models.Error) bool {
+	return err.CorrespondingHttpCode >= http.StatusInternalServerError
+}
+
+// upstreamError returns the error reported by a BST API response. Failed
+// responses whose body is not an error of the BST API, such as the html page
+// of a gateway, are mapped to an error by their status code.
+func upstreamError(status int, body []byte) bst_models.Error {
+	err := bst_models.ErrorOK
+	decoded := json.Unmarshal(body, &err) == nil
+	if status == http.StatusOK {
+		if !decoded {
+			return bst_models.ErrorOK
+		}
+		return err
+	}
+	if decoded && !err.Equals(bst_models.ErrorOK) {
+		return err
+	}
+
+	switch {
+	case status == http.StatusUnauthorized:
+		return bst_models.ErrorJwt
+	case status == http.StatusForbidden:
+		return bst_models.ErrorScope
+	}
+	err = bst_models.ErrorApiInaccessible
+	if status >= http.StatusBadRequest {
+		err.CorrespondingHttpCode = status
+	} else {
+		err.CorrespondingHttpCode = http.StatusBadGateway
+	}
+	return err
+}
+
+// storeLastKnownGood keeps a successful response for use while the BST API
+// is unavailable. It is written in the background, as the cache is usually
+// on disk.
+func storeLastKnownGood(cacheName string, sub string, response utilities.CachedResponse) {
+	utilities.SetCacheValueAsync(utilities.LastKnownGoodCache, utilities.LastKnownGoodKey(cacheName, sub), response)
+}
+
+// lastKnownGood returns the last successful response of the user for the
+// endpoint, marked as stale, along with its age in seconds.
+func lastKnownGood(cacheName string, sub string) (response utilities.CachedResponse, age int, ok bool) {
+	response, ok = utilities.GetCacheValue(utilities.LastKnownGoodCache, utilities.LastKnownGoodKey(cacheName, sub)).(utilities.CachedResponse)
+	if !ok {
+		return
+	}
+
+	degraded.servedStale()
+	age = int(time.Since(response.Stored).Seconds())
+	response.Body = markStale(response.Body, age)
+	response.ETag = utilities.ContentETag(response.Body)
+	return
+}
+
+// markStaleHeaders flags a response as served from last-known-good data.
+func markStaleHeaders(rw http.ResponseWriter, age int) {
+	rw.Header().Set(staleHeader, "true")
+	rw.Header().Set(staleAgeHeader, strconv.Itoa(age))
+	rw.Header().Set("Warning", `110 - "Response is Stale"`)
+}
+
+// markStale adds `stale` and `stale_age` to JSON object bodies. Other bodies
+// are returned unchanged and rely on the stale headers alone.
+func markStale(body []byte, age int) []byte {
+	object := make(map[string]json.RawMessage)
+	if json.Unmarshal(body, &object) != nil {
+		return body
+	}
+	object["stale"] = json.RawMessage("true")
+	object["stale_age"] = json.RawMessage(strconv.Itoa(age))
+
+	marked, err := json.Marshal(object)
+	if err != nil {
+		return body
+	}
+	return marked
+}
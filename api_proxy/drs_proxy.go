@@ -2,6 +2,7 @@ package api_proxy
 
 import (
 	"bst_web/utilities"
+	"context"
 	"encoding/json"
 	"fmt"
 	bst_models "github.com/chris-sg/bst_server_models"
@@ -9,11 +10,10 @@ import (
 	"github.com/urfave/negroni"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 )
 
 func CreateDrsProxy(prefix string) *mux.Router {
-	drsProxy := mux.NewRouter().PathPrefix(prefix + "/drs").Subrouter()
+	drsProxy := utilities.HandleRouterErrors(mux.NewRouter().PathPrefix(prefix + "/drs").Subrouter())
 
 	drsProxy.Path("/profile").Handler(negroni.New(
 		negroni.Wrap(http.HandlerFunc(DrsProfilePatch)))).Methods(http.MethodPatch)
@@ -30,13 +30,15 @@ func CreateDrsProxy(prefix string) *mux.Router {
 func DrsProfilePatch(rw http.ResponseWriter, r *http.Request) {
 	token, err := utilities.TokenForRequest(r)
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
 
-	err = DrsProfilePatchImpl(token)
+	err = DrsProfilePatchImpl(r.Context(), token)
+	utilities.Audit(r, utilities.AuditProfileUpdate, utilities.AuditOutcome(err), "drs")
+	if err.Equals(bst_models.ErrorOK) {
+		evictResponseCaches(r, drsDetailsCache, drsTabledataCache)
+	}
 
 	bytes, _ := json.Marshal(err)
 	if !err.Equals(bst_models.ErrorOK) {
@@ -48,9 +50,9 @@ func DrsProfilePatch(rw http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func DrsProfilePatchImpl(token string) (err bst_models.Error) {
+func DrsProfilePatchImpl(ctx context.Context, token string) (err bst_models.Error) {
 	err = bst_models.ErrorOK
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "drs/profile")
+	uri := utilities.BstApiUrl("drs/profile")
 
 	req := &http.Request{
 		Method:           http.MethodPatch,
@@ -59,7 +61,7 @@ func DrsProfilePatchImpl(token string) (err bst_models.Error) {
 	}
 	req.Header.Add("Authorization", "Bearer " + token)
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -73,37 +75,18 @@ func DrsProfilePatchImpl(token string) (err bst_models.Error) {
 		return
 	}
 
-	json.Unmarshal(body, &err)
+	err = upstreamError(res.StatusCode, body)
 
 	return
 }
 
 func DrsDetailsGet(rw http.ResponseWriter, r *http.Request) {
-	token, err := utilities.TokenForRequest(r)
-	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
-		return
-	}
-
-	response, err := DrsDetailsGetImpl(token)
-
-	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
-		return
-	}
-
-	rw.WriteHeader(err.CorrespondingHttpCode)
-	rw.Write(response)
-	return
+	serveCachedResponse(rw, r, drsDetailsCache, DrsDetailsGetImpl)
 }
 
-func DrsDetailsGetImpl(token string) (response []byte, err bst_models.Error) {
+func DrsDetailsGetImpl(ctx context.Context, token string) (response []byte, err bst_models.Error) {
 	err = bst_models.ErrorOK
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "drs/details")
+	uri := utilities.BstApiUrl("drs/details")
 
 	req := &http.Request{
 		Method:           http.MethodGet,
@@ -112,7 +95,7 @@ func DrsDetailsGetImpl(token string) (response []byte, err bst_models.Error) {
 	}
 	req.Header.Add("Authorization", "Bearer " + token)
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -125,34 +108,21 @@ func DrsDetailsGetImpl(token string) (response []byte, err bst_models.Error) {
 		return
 	}
 
-	return
-}
-
-func DrsTabledataGet(rw http.ResponseWriter, r *http.Request) {
-	token, err := utilities.TokenForRequest(r)
-	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
-		return
-	}
-
-	response, err := DrsTabledataGetImpl(token)
-	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+	if res.StatusCode != http.StatusOK {
+		err = upstreamError(res.StatusCode, response)
 		return
 	}
 
-	rw.WriteHeader(http.StatusOK)
-	rw.Write(response)
 	return
 }
 
-func DrsTabledataGetImpl(token string) (response []byte, err bst_models.Error) {
+func DrsTabledataGet(rw http.ResponseWriter, r *http.Request) {
+	serveCachedResponse(rw, r, drsTabledataCache, DrsTabledataGetImpl)
+}
+
+func DrsTabledataGetImpl(ctx context.Context, token string) (response []byte, err bst_models.Error) {
 	err = bst_models.ErrorOK
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "drs/tabledata")
+	uri := utilities.BstApiUrl("drs/tabledata")
 
 	req := &http.Request{
 		Method:           http.MethodGet,
@@ -161,7 +131,7 @@ func DrsTabledataGetImpl(token string) (response []byte, err bst_models.Error) {
 	}
 	req.Header.Add("Authorization", "Bearer " + token)
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -175,7 +145,7 @@ func DrsTabledataGetImpl(token string) (response []byte, err bst_models.Error) {
 	}
 
 	if res.StatusCode != http.StatusOK {
-		json.Unmarshal(response, &err)
+		err = upstreamError(res.StatusCode, response)
 		return
 	}
 
@@ -2,6 +2,7 @@ package api_proxy
 
 import (
 	"bst_web/utilities"
+	"context"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -11,19 +12,27 @@ import (
 	"github.com/urfave/negroni"
 	"io/ioutil"
 	"net/http"
-	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // CreateBstApiRouter will generate a router mapped against BST API. Middleware
 // may be passed in to then be used by certain routes.
 func CreateBstApiRouter(prefix string, middleware map[string]*negroni.Negroni) *mux.Router {
-	bstApiRouter := mux.NewRouter().PathPrefix(prefix + "/api").Subrouter()
+	bstApiRouter := utilities.HandleRouterErrors(mux.NewRouter().PathPrefix(prefix + "/api").Subrouter())
 	bstApiRouter.PathPrefix("/ddr").Handler(negroni.New(
 		negroni.Wrap(CreateDdrProxy(prefix + "/api"))))
 	bstApiRouter.PathPrefix("/drs").Handler(negroni.New(
 		negroni.Wrap(CreateDrsProxy(prefix + "/api"))))
 	bstApiRouter.Path("/status").Handler(negroni.New(
 		negroni.Wrap(http.HandlerFunc(StatusGet)))).Methods(http.MethodGet)
+	bstApiRouter.Path("/status/history").Handler(negroni.New(
+		negroni.Wrap(http.HandlerFunc(StatusHistoryGet)))).Methods(http.MethodGet)
+	bstApiRouter.Path("/dashboard").Handler(negroni.New(
+		negroni.Wrap(http.HandlerFunc(DashboardGet)))).Methods(http.MethodGet)
+	bstApiRouter.Path("/batch").Handler(negroni.New(
+		negroni.Wrap(BatchPost(bstApiRouter, prefix+"/api")))).Methods(http.MethodPost)
 	bstApiRouter.Path("/bstuser").Handler(negroni.New(
 		negroni.Wrap(http.HandlerFunc(BstUserPut)))).Methods(http.MethodPut)
 	bstApiRouter.Path("/eagate/login").Handler(negroni.New(
@@ -36,22 +45,40 @@ func CreateBstApiRouter(prefix string, middleware map[string]*negroni.Negroni) *
 	return bstApiRouter
 }
 
-// StatusGet will call StatusGetImpl() and return the result.
+// StatusResponse extends the api status with the degraded state of this
+// server.
+type StatusResponse struct {
+	bst_models.ApiStatus
+	Degraded      bool       `json:"degraded"`
+	DegradedSince *time.Time `json:"degraded_since,omitempty"`
+	CachedData    bool       `json:"cached_data"`
+	Message       string     `json:"message,omitempty"`
+}
+
+// StatusGet will return the status last polled by the status poller.
 func StatusGet(rw http.ResponseWriter, r *http.Request) {
-	status, err := StatusGetImpl()
-	if !err.Equals(bst_models.ErrorOK) {
-		glog.Error(err)
+	response := StatusResponse{
+		ApiStatus: CurrentStatus(r.Context()),
+	}
+	since, staleServed := degraded.status()
+	if !since.IsZero() {
+		response.Degraded = true
+		response.DegradedSince = &since
+		response.CachedData = staleServed > 0
+		if response.CachedData {
+			response.Message = "showing cached data"
+		}
 	}
 
-	bytes, _ := json.Marshal(status)
+	bytes, _ := json.Marshal(response)
 	rw.WriteHeader(http.StatusOK)
 	rw.Write(bytes)
 }
 
 // StatusGetImpl will retrieve the current state of the api, the database and eagate.
-func StatusGetImpl() (status bst_models.ApiStatus, err bst_models.Error) {
+func StatusGetImpl(ctx context.Context) (status bst_models.ApiStatus, err bst_models.Error) {
 	err = bst_models.ErrorOK
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "status")
+	uri := utilities.BstApiUrl("status")
 
 	status.Api = "bad"
 	status.EaGate = "bad"
@@ -61,7 +88,7 @@ func StatusGetImpl() (status bst_models.ApiStatus, err bst_models.Error) {
 		Method:           http.MethodGet,
 		URL:              uri,
 	}
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -83,36 +110,46 @@ func StatusGetImpl() (status bst_models.ApiStatus, err bst_models.Error) {
 	return
 }
 
-// StatusGet will call StatusGetImpl() and return the result.
+// BstUserPut will validate a bstuser update and forward it to BstUserPutImpl().
 func BstUserPut(rw http.ResponseWriter, r *http.Request) {
 	token, err := utilities.TokenForRequest(r)
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
 
 	profile, err := utilities.ProfileForRequest(r)
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
 
 	sub, ok := profile["sub"].(string)
 	if !ok {
-		bytes, _ := json.Marshal(bst_models.ErrorJwtProfile)
-		rw.WriteHeader(bst_models.ErrorJwtProfile.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, bst_models.ErrorJwtProfile)
+		return
+	}
+	// the body is forwarded as sent, so fields left out stay unchanged
+	body, e := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, maxBstUserBodySize))
+	if e != nil {
+		writeValidationError(rw, bst_models.ErrorBadBody, []FieldError{{"", fmt.Sprintf("body exceeds %d bytes", maxBstUserBodySize)}})
 		return
 	}
-	user, err := BstUserPutImpl(token, sub, r)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	update := bst_models.UserCache{}
+	fields := decodeJsonBody(rw, r, maxBstUserBodySize, &update)
+	if len(fields) == 0 {
+		fields = ValidateBstUserUpdate(update)
+	}
+	if len(fields) > 0 {
+		writeValidationError(rw, bst_models.ErrorBadBody, fields)
+		return
+	}
+
+	user, err := BstUserPutImpl(r.Context(), token, sub, body)
+	utilities.AuditSub(r, sub, utilities.AuditBstUserUpdate, utilities.AuditOutcome(err), err.Message)
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
 
@@ -122,11 +159,11 @@ func BstUserPut(rw http.ResponseWriter, r *http.Request) {
 	return
 }
 
-// StatusGetImpl will retrieve the current state of the api, the database and eagate.
-func BstUserPutImpl(token string, sub string, r *http.Request) (userCache bst_models.UserCache, err bst_models.Error) {
+// BstUserPutImpl will store the users profile changes and refresh their cached data.
+func BstUserPutImpl(ctx context.Context, token string, sub string, request []byte) (userCache bst_models.UserCache, err bst_models.Error) {
 	err = bst_models.ErrorOK
-	utilities.ClearCacheValue("users", sub)
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "bstuser")
+	utilities.ClearUserCacheValue("users", sub)
+	uri := utilities.BstApiUrl("bstuser")
 
 	req := &http.Request{
 		Method:           http.MethodPut,
@@ -135,14 +172,9 @@ func BstUserPutImpl(token string, sub string, r *http.Request) (userCache bst_mo
 	}
 	req.Header.Add("Authorization", "Bearer " + token)
 
-	request, e := ioutil.ReadAll(r.Body)
-	if e != nil {
-		err = bst_models.ErrorBadBody
-		return
-	}
 	req.Body = ioutil.NopCloser(bytes.NewReader(request))
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -161,24 +193,20 @@ func BstUserPutImpl(token string, sub string, r *http.Request) (userCache bst_mo
 		return
 	}
 
-	utilities.SetCacheValue("users", sub, userCache)
+	utilities.SetCacheValue("users", utilities.UserCacheKey(ctx, sub), userCache)
 	return
 }
 
 func EagateLoginGet(rw http.ResponseWriter, r *http.Request) {
 	token, err := utilities.TokenForRequest(r)
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
-	err, users := EagateLoginGetImpl(token)
+	err, users := EagateLoginGetImpl(r.Context(), token)
 
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
 
@@ -188,10 +216,10 @@ func EagateLoginGet(rw http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func EagateLoginGetImpl(token string) (err bst_models.Error, users []bst_models.EagateUser){
+func EagateLoginGetImpl(ctx context.Context, token string) (err bst_models.Error, users []bst_models.EagateUser){
 	err = bst_models.ErrorOK
 
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "user/login")
+	uri := utilities.BstApiUrl("user/login")
 
 	req := &http.Request{
 		Method:           http.MethodGet,
@@ -200,7 +228,7 @@ func EagateLoginGetImpl(token string) (err bst_models.Error, users []bst_models.
 	}
 	req.Header.Add("Authorization", "Bearer " + token)
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -222,25 +250,38 @@ func EagateLoginGetImpl(token string) (err bst_models.Error, users []bst_models.
 func EagateLoginPost(rw http.ResponseWriter, r *http.Request) {
 	token, err := utilities.TokenForRequest(r)
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
 
-	defer r.Body.Close()
-	body, e := ioutil.ReadAll(r.Body)
-	if e != nil {
-		bytes, _ := json.Marshal(bst_models.ErrorBadBody)
-		rw.WriteHeader(bst_models.ErrorBadBody.CorrespondingHttpCode)
-		rw.Write(bytes)
+	loginRequest := bst_models.LoginRequest{}
+	fields := decodeJsonBody(rw, r, maxLoginBodySize, &loginRequest)
+	if len(fields) == 0 {
+		fields = ValidateLoginRequest(loginRequest)
+	}
+	if len(fields) > 0 {
+		writeValidationError(rw, bst_models.ErrorBadBody, fields)
 		return
 	}
 
-	loginRequest := bst_models.LoginRequest{}
-	json.Unmarshal(body, &loginRequest)
+	sub := utilities.SubForRequest(r)
+	retryAfter, err := utilities.ReserveEagateLogin(sub, utilities.ClientIp(r), loginRequest.Username)
+	if !err.Equals(bst_models.ErrorOK) {
+		utilities.Audit(r, utilities.AuditEagateLogin, utilities.AuditFailure, "eagate user " + loginRequest.Username + ": " + err.Message)
+		rw.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		utilities.RenderError(rw, r, err)
+		return
+	}
 
-	err = EagateLoginPostImpl(token, loginRequest)
+	err = EagateLoginPostImpl(r.Context(), token, loginRequest)
+	utilities.Audit(r, utilities.AuditEagateLogin, utilities.AuditOutcome(err), "eagate user " + loginRequest.Username)
+	if err.Equals(bst_models.ErrorOK) {
+		utilities.RecordEagateLogin(r, sub, loginRequest.Username, true)
+	} else if err.CorrespondingHttpCode < http.StatusInternalServerError {
+		utilities.RecordEagateLogin(r, sub, loginRequest.Username, false)
+	} else {
+		utilities.ReleaseEagateLogin(r, sub, loginRequest.Username)
+	}
 
 	bytes, _ := json.Marshal(err)
 	if !err.Equals(bst_models.ErrorOK) {}
@@ -251,9 +292,9 @@ func EagateLoginPost(rw http.ResponseWriter, r *http.Request) {
 }
 
 // TODO: use form instead of body
-func EagateLoginPostImpl(token string, loginRequest bst_models.LoginRequest) (err bst_models.Error) {
+func EagateLoginPostImpl(ctx context.Context, token string, loginRequest bst_models.LoginRequest) (err bst_models.Error) {
 	err = bst_models.ErrorOK
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "user/login")
+	uri := utilities.BstApiUrl("user/login")
 
 	req := &http.Request{
 		Method:           http.MethodPost,
@@ -265,7 +306,7 @@ func EagateLoginPostImpl(token string, loginRequest bst_models.LoginRequest) (er
 	b, _ := json.Marshal(loginRequest)
 	req.Body = ioutil.NopCloser(bytes.NewReader(b))
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -277,7 +318,7 @@ func EagateLoginPostImpl(token string, loginRequest bst_models.LoginRequest) (er
 		err = bst_models.ErrorClientResponse
 		return
 	}
-	json.Unmarshal(body, &err)
+	err = upstreamError(res.StatusCode, body)
 
 	return
 }
@@ -286,31 +327,22 @@ func EagateLoginPostImpl(token string, loginRequest bst_models.LoginRequest) (er
 func EagateLogoutPost(rw http.ResponseWriter, r *http.Request) {
 	token, err := utilities.TokenForRequest(r)
 	if !err.Equals(bst_models.ErrorOK) {
-		bytes, _ := json.Marshal(err)
-		rw.WriteHeader(err.CorrespondingHttpCode)
-		rw.Write(bytes)
-		return
-	}
-
-	defer r.Body.Close()
-	body, e := ioutil.ReadAll(r.Body)
-	if e != nil {
-		bytes, _ := json.Marshal(bst_models.ErrorBadRequest)
-		rw.WriteHeader(bst_models.ErrorBadRequest.CorrespondingHttpCode)
-		rw.Write(bytes)
+		utilities.RenderError(rw, r, err)
 		return
 	}
 
 	logoutRequest := bst_models.LogoutRequest{}
-	e = json.Unmarshal(body, &logoutRequest)
-	if e != nil {
-		bytes, _ := json.Marshal(bst_models.ErrorJsonDecode)
-		rw.WriteHeader(bst_models.ErrorJsonDecode.CorrespondingHttpCode)
-		rw.Write(bytes)
+	fields := decodeJsonBody(rw, r, maxLogoutBodySize, &logoutRequest)
+	if len(fields) == 0 {
+		fields = ValidateLogoutRequest(logoutRequest)
+	}
+	if len(fields) > 0 {
+		writeValidationError(rw, bst_models.ErrorBadBody, fields)
 		return
 	}
 
-	err = EagateLogoutPostImpl(token, logoutRequest)
+	err = EagateLogoutPostImpl(r.Context(), token, logoutRequest)
+	utilities.Audit(r, utilities.AuditEagateLogout, utilities.AuditOutcome(err), "eagate user " + logoutRequest.Username)
 	b, e := json.Marshal(err)
 	if e != nil {
 		b, _ := json.Marshal(bst_models.ErrorJsonEncode)
@@ -328,9 +360,9 @@ func EagateLogoutPost(rw http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func EagateLogoutPostImpl(token string, logoutRequest bst_models.LogoutRequest) (err bst_models.Error) {
+func EagateLogoutPostImpl(ctx context.Context, token string, logoutRequest bst_models.LogoutRequest) (err bst_models.Error) {
 	err = bst_models.ErrorOK
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "user/logout")
+	uri := utilities.BstApiUrl("user/logout")
 
 	req := &http.Request{
 		Method:           http.MethodPost,
@@ -342,7 +374,7 @@ func EagateLogoutPostImpl(token string, logoutRequest bst_models.LogoutRequest)
 	b, _ := json.Marshal(logoutRequest)
 	req.Body = ioutil.NopCloser(bytes.NewReader(b))
 
-	res, e := utilities.GetClient().Do(req)
+	res, e := utilities.GetClient().Do(req.WithContext(ctx))
 	if e != nil {
 		err = bst_models.ErrorClientRequest
 		return
@@ -354,7 +386,51 @@ func EagateLogoutPostImpl(token string, logoutRequest bst_models.LogoutRequest)
 		err = bst_models.ErrorClientResponse
 		return
 	}
-	json.Unmarshal(body, &err)
+	err = upstreamError(res.StatusCode, body)
 
 	return
-}
\ No newline at end of file
+}
+// UserCacheFor returns the cached data of the user, loading it from the api
+// when it is not cached yet.
+func UserCacheFor(ctx context.Context, sub string) (userCache bst_models.UserCache, ok bool) {
+	key := utilities.UserCacheKey(ctx, sub)
+	if userCache, ok = utilities.GetCacheValue("users", key).(bst_models.UserCache); ok {
+		return
+	}
+
+	glog.Infof("cache not found for %s. Loading from api", sub)
+	LoadUserCache(ctx, strings.ToLower(sub))
+	if userCache, ok = utilities.GetCacheValue("users", key).(bst_models.UserCache); !ok {
+		glog.Warningf("cache still could not be found for %s", sub)
+	}
+	return
+}
+
+func LoadUserCache(ctx context.Context, user string) bool {
+	glog.Infof("loading cache for user %s", user)
+	uri := utilities.BstApiUrl("cache")
+
+	query := uri.Query()
+	query.Set("user", user)
+	uri.RawQuery = query.Encode()
+
+	req := &http.Request{
+		Method:           http.MethodGet,
+		URL:              uri,
+	}
+
+	res, err := utilities.GetClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false
+	}
+
+	cacheData := bst_models.UserCache{}
+	json.NewDecoder(res.Body).Decode(&cacheData)
+
+	glog.Infof("%s cache loaded, user id %d", user, cacheData.Id)
+	return utilities.SetCacheValue("users", utilities.UserCacheKey(ctx, user), cacheData)
+}
@@ -0,0 +1,125 @@
+package api_proxy
+
+import (
+	"bst_web/utilities"
+	"context"
+	"encoding/json"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"net/http"
+)
+
+// Per-user response caches. They are evicted when the user refreshes or
+// updates the matching profile, or on invalidation from the BST API.
+const (
+	ddrStatsCache     = "ddr_stats"
+	ddrProfileCache   = "ddr_profile"
+	drsDetailsCache   = "drs_details"
+	drsTabledataCache = "drs_tabledata"
+)
+
+type responseFetcher func(ctx context.Context, token string) ([]byte, bst_models.Error)
+
+// serveCachedResponse answers from the named per-user cache when possible,
+// otherwise calls fetch and caches a successful result. Responses carry a
+// strong ETag so clients revalidating with If-None-Match receive a 304. When
+// the BST API is unavailable the last known good response is served instead.
+func serveCachedResponse(rw http.ResponseWriter, r *http.Request, cacheName string, fetch responseFetcher) {
+	token, err := utilities.TokenForRequest(r)
+	if !err.Equals(bst_models.ErrorOK) {
+		utilities.RenderError(rw, r, err)
+		return
+	}
+
+	result := cachedFetch(r.Context(), token, utilities.SubForRequest(r), cacheName, fetch)
+	if !result.Err.Equals(bst_models.ErrorOK) {
+		utilities.RenderError(rw, r, result.Err)
+		return
+	}
+
+	if result.Stale {
+		markStaleHeaders(rw, result.StaleAge)
+		rw.Header().Set("X-Cache", "STALE")
+	} else if result.Hit {
+		rw.Header().Set("X-Cache", "HIT")
+	} else {
+		rw.Header().Set("X-Cache", "MISS")
+	}
+	writeCachedResponse(rw, r, result.Response)
+}
+
+// fetchResult is the outcome of cachedFetch.
+type fetchResult struct {
+	Response utilities.CachedResponse
+	Hit      bool
+	Stale    bool
+	StaleAge int
+	Err      bst_models.Error
+}
+
+// cachedFetch returns the users entry of the named cache, or calls fetch and
+// caches a successful result. Only bodies of successful, valid json responses
+// are cached. When the BST API is unavailable the last known
+// good response is returned, marked as stale.
+func cachedFetch(ctx context.Context, token string, sub string, cacheName string, fetch responseFetcher) (result fetchResult) {
+	result.Err = bst_models.ErrorOK
+	key := utilities.UserCacheKey(ctx, sub)
+	if len(key) > 0 {
+		if cached, ok := utilities.GetCacheValue(cacheName, key).(utilities.CachedResponse); ok {
+			result.Response = cached
+			result.Hit = true
+			return
+		}
+	}
+
+	body, err := fetch(ctx, token)
+	if err.Equals(bst_models.ErrorOK) && !json.Valid(body) {
+		err = upstreamError(http.StatusBadGateway, nil)
+	}
+	if !err.Equals(bst_models.ErrorOK) {
+		if isUpstreamFailure(err) {
+			degraded.upstreamFailed()
+			if len(key) > 0 {
+				if response, age, ok := lastKnownGood(cacheName, key); ok {
+					result.Response = response
+					result.Stale = true
+					result.StaleAge = age
+					return
+				}
+			}
+		}
+		result.Err = err
+		return
+	}
+	degraded.upstreamRecovered()
+
+	result.Response = utilities.NewCachedResponse(body)
+	if len(key) > 0 {
+		utilities.SetCacheValue(cacheName, key, result.Response)
+		storeLastKnownGood(cacheName, key, result.Response)
+	}
+	return
+}
+
+func writeCachedResponse(rw http.ResponseWriter, r *http.Request, response utilities.CachedResponse) {
+	rw.Header().Set("ETag", response.ETag)
+	rw.Header().Set("Cache-Control", "private, no-cache")
+	if utilities.ETagMatches(r, response.ETag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(response.Body)
+}
+
+// evictResponseCaches drops the named per-user caches of the request user.
+func evictResponseCaches(r *http.Request, cacheNames ...string) {
+	sub := utilities.SubForRequest(r)
+	if len(sub) == 0 {
+		return
+	}
+	for _, cacheName := range cacheNames {
+		utilities.ClearUserCacheValue(cacheName, sub)
+	}
+}
@@ -0,0 +1,217 @@
+package api_proxy
+
+import (
+	"context"
+	"encoding/json"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"github.com/golang/glog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Status components tracked in the uptime history.
+const (
+	ComponentApi    = "api"
+	ComponentDb     = "db"
+	ComponentEaGate = "gate"
+)
+
+var (
+	statusComponents = []string{ComponentApi, ComponentDb, ComponentEaGate}
+	statusWindows    = []time.Duration{24 * time.Hour, 7 * 24 * time.Hour}
+
+	statusHistory = &statusRecorder{}
+)
+
+// StatusSample is a single poll of the BST API status.
+type StatusSample struct {
+	Time   time.Time            `json:"time"`
+	Status bst_models.ApiStatus `json:"status"`
+}
+
+// Incident is a window during which a component was down. End is nil while
+// the incident is ongoing.
+type Incident struct {
+	Component string     `json:"component"`
+	Start     time.Time  `json:"start"`
+	End       *time.Time `json:"end,omitempty"`
+}
+
+// ComponentUptime holds the uptime percentage of a component per window,
+// keyed by the window duration, e.g. "24h0m0s".
+type ComponentUptime struct {
+	Component string             `json:"component"`
+	Up        bool               `json:"up"`
+	Uptime    map[string]float64 `json:"uptime"`
+}
+
+// StatusReport summarises the retained status history.
+type StatusReport struct {
+	Updated    time.Time         `json:"updated"`
+	Since      time.Time         `json:"since"`
+	Interval   string            `json:"interval"`
+	Components []ComponentUptime `json:"components"`
+	Incidents  []Incident        `json:"incidents"`
+}
+
+type statusRecorder struct {
+	sync.RWMutex
+	interval  time.Duration
+	retention time.Duration
+	samples   []StatusSample
+}
+
+// StartStatusPoller polls the BST API status every interval, keeping samples
+// for the retention period.
+func StartStatusPoller(interval time.Duration, retention time.Duration) {
+	statusHistory.Lock()
+	statusHistory.interval = interval
+	statusHistory.retention = retention
+	statusHistory.Unlock()
+
+	go func() {
+		for {
+			statusHistory.poll()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (s *statusRecorder) poll() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	status, err := StatusGetImpl(ctx)
+	if !err.Equals(bst_models.ErrorOK) {
+		glog.Warningf("status poll failed: %s", err.Message)
+	}
+	s.record(StatusSample{
+		Time:   time.Now(),
+		Status: status,
+	})
+}
+
+func (s *statusRecorder) record(sample StatusSample) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.samples = append(s.samples, sample)
+	cutoff := sample.Time.Add(-s.retention)
+	drop := 0
+	for drop < len(s.samples) && s.samples[drop].Time.Before(cutoff) {
+		drop++
+	}
+	if drop > 0 {
+		s.samples = append(s.samples[:0:0], s.samples[drop:]...)
+	}
+}
+
+// Latest returns the most recent sample, if any poll has completed.
+func (s *statusRecorder) Latest() (StatusSample, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.samples) == 0 {
+		return StatusSample{}, false
+	}
+	return s.samples[len(s.samples)-1], true
+}
+
+// Report computes uptime percentages and incident windows from the history.
+func (s *statusRecorder) Report() StatusReport {
+	s.RLock()
+	defer s.RUnlock()
+
+	report := StatusReport{
+		Interval:   s.interval.String(),
+		Components: make([]ComponentUptime, 0, len(statusComponents)),
+		Incidents:  make([]Incident, 0),
+	}
+	if len(s.samples) == 0 {
+		return report
+	}
+
+	latest := s.samples[len(s.samples)-1]
+	report.Updated = latest.Time
+	report.Since = s.samples[0].Time
+
+	for _, component := range statusComponents {
+		uptime := ComponentUptime{
+			Component: component,
+			Up:        componentUp(latest.Status, component),
+			Uptime:    make(map[string]float64),
+		}
+		for _, window := range statusWindows {
+			cutoff := latest.Time.Add(-window)
+			total, up := 0, 0
+			for _, sample := range s.samples {
+				if sample.Time.Before(cutoff) {
+					continue
+				}
+				total++
+				if componentUp(sample.Status, component) {
+					up++
+				}
+			}
+			uptime.Uptime[window.String()] = float64(up) * 100 / float64(total)
+		}
+		report.Components = append(report.Components, uptime)
+
+		var current *Incident
+		for _, sample := range s.samples {
+			isUp := componentUp(sample.Status, component)
+			if !isUp && current == nil {
+				current = &Incident{Component: component, Start: sample.Time}
+			} else if isUp && current != nil {
+				end := sample.Time
+				current.End = &end
+				report.Incidents = append(report.Incidents, *current)
+				current = nil
+			}
+		}
+		if current != nil {
+			report.Incidents = append(report.Incidents, *current)
+		}
+	}
+
+	return report
+}
+
+func componentUp(status bst_models.ApiStatus, component string) bool {
+	var value string
+	switch component {
+	case ComponentApi:
+		value = status.Api
+	case ComponentDb:
+		value = status.Db
+	case ComponentEaGate:
+		value = status.EaGate
+	}
+	return len(value) > 0 && value != "bad"
+}
+
+// CurrentStatus returns the last polled status, polling synchronously when
+// the poller has not completed yet.
+func CurrentStatus(ctx context.Context) bst_models.ApiStatus {
+	if sample, ok := statusHistory.Latest(); ok {
+		return sample.Status
+	}
+	status, err := StatusGetImpl(ctx)
+	if !err.Equals(bst_models.ErrorOK) {
+		glog.Error(err)
+	}
+	return status
+}
+
+// CurrentStatusReport returns the uptime report of the retained history.
+func CurrentStatusReport() StatusReport {
+	return statusHistory.Report()
+}
+
+// StatusHistoryGet returns uptime percentages and incidents per component.
+func StatusHistoryGet(rw http.ResponseWriter, r *http.Request) {
+	bytes, _ := json.Marshal(CurrentStatusReport())
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(bytes)
+}
@@ -0,0 +1,225 @@
+package api_proxy
+
+import (
+	"bst_web/utilities"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxLoginBodySize   = 4 * 1024
+	maxLogoutBodySize  = 1024
+	maxBstUserBodySize = 4 * 1024
+	maxSongScoreIds    = 50
+	maxBatchBodySize   = 256 * 1024
+)
+
+var (
+	songIdPattern   = regexp.MustCompile(`^[0-9A-Za-z]{1,64}$`)
+	otpPattern      = regexp.MustCompile(`^[0-9A-Za-z]{1,16}$`)
+	batchMethods    = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch}
+	// paths that may not be batched: nested batches, and eagate logins,
+	// which would multiply password attempts per request
+	batchExcludedPaths = []string{"/batch", "/eagate/login", "/eagate/logout"}
+)
+
+// FieldError describes why a single field of a request was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned to the client when a request does not match
+// its declared schema. It extends bst_models.Error with per-field details.
+type ValidationError struct {
+	bst_models.Error
+	Fields []FieldError
+}
+
+// decodeJsonBody strictly decodes at most limit bytes of the request body
+// into target. Unknown fields, trailing data and type mismatches are
+// reported as field errors.
+func decodeJsonBody(rw http.ResponseWriter, r *http.Request, limit int64, target interface{}) (fields []FieldError) {
+	defer r.Body.Close()
+	decoder := json.NewDecoder(http.MaxBytesReader(rw, r.Body, limit))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(target)
+	if err == nil {
+		if _, e := decoder.Token(); e != io.EOF {
+			err = errors.New("unexpected data after json object")
+		}
+	}
+	if err == nil {
+		return
+	}
+
+	var typeError *json.UnmarshalTypeError
+	var syntaxError *json.SyntaxError
+	switch {
+	case errors.As(err, &typeError):
+		fields = append(fields, FieldError{typeError.Field, "must be of type " + typeError.Type.String()})
+	case err == io.ErrUnexpectedEOF:
+		fields = append(fields, FieldError{"", "malformed json, unexpected end of body"})
+	case errors.As(err, &syntaxError):
+		fields = append(fields, FieldError{"", fmt.Sprintf("malformed json at offset %d", syntaxError.Offset)})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), "\"")
+		fields = append(fields, FieldError{field, "unknown field"})
+	case err.Error() == "http: request body too large":
+		fields = append(fields, FieldError{"", fmt.Sprintf("body exceeds %d bytes", limit)})
+	case err == io.EOF:
+		fields = append(fields, FieldError{"", "body is empty"})
+	default:
+		fields = append(fields, FieldError{"", err.Error()})
+	}
+	return
+}
+
+func validateString(fields []FieldError, name string, value string, required bool, maxLength int) []FieldError {
+	if len(value) == 0 {
+		if required {
+			fields = append(fields, FieldError{name, "is required"})
+		}
+		return fields
+	}
+	if !utf8.ValidString(value) {
+		return append(fields, FieldError{name, "must be valid utf-8"})
+	}
+	if utf8.RuneCountInString(value) > maxLength {
+		return append(fields, FieldError{name, fmt.Sprintf("must be at most %d characters", maxLength)})
+	}
+	for _, c := range value {
+		if unicode.IsControl(c) {
+			return append(fields, FieldError{name, "must not contain control characters"})
+		}
+	}
+	return fields
+}
+
+func validateOneOf(fields []FieldError, name string, value string, allowed []string) []FieldError {
+	for _, a := range allowed {
+		if value == a {
+			return fields
+		}
+	}
+	return append(fields, FieldError{name, "must be one of " + strings.Join(allowed, ", ")})
+}
+
+// ValidateLoginRequest checks an eagate login request.
+func ValidateLoginRequest(request bst_models.LoginRequest) (fields []FieldError) {
+	fields = validateString(fields, "username", request.Username, true, 64)
+	fields = validateString(fields, "password", request.Password, true, 128)
+	if len(request.OneTimePassword) > 0 && !otpPattern.MatchString(request.OneTimePassword) {
+		fields = append(fields, FieldError{"otp", "must be at most 16 alphanumeric characters"})
+	}
+	return
+}
+
+// ValidateLogoutRequest checks an eagate logout request.
+func ValidateLogoutRequest(request bst_models.LogoutRequest) (fields []FieldError) {
+	return validateString(fields, "username", request.Username, true, 64)
+}
+
+// ValidateBstUserUpdate checks a bstuser update. Fields left out are not
+// changed by the api, so none of them is required.
+func ValidateBstUserUpdate(update bst_models.UserCache) (fields []FieldError) {
+	fields = validateString(fields, "nickname", update.Nickname, false, 32)
+	if len(update.Nickname) > 0 && len(strings.TrimSpace(update.Nickname)) == 0 {
+		fields = append(fields, FieldError{"nickname", "must not be blank"})
+	}
+	if update.Id < 0 {
+		fields = append(fields, FieldError{"id", "must not be negative"})
+	}
+	return
+}
+
+// ParseSongScoresQuery validates the song ids of a ddr song scores request,
+// given as ids, either repeated or comma separated. Other parameters are
+// passed to the api as they are.
+func ParseSongScoresQuery(rawQuery string) (values url.Values, fields []FieldError) {
+	values, e := url.ParseQuery(rawQuery)
+	if e != nil {
+		fields = append(fields, FieldError{"", "malformed query string"})
+		return
+	}
+
+	count := 0
+	for _, value := range values["ids"] {
+		for _, id := range strings.Split(value, ",") {
+			count++
+			if !songIdPattern.MatchString(id) {
+				fields = append(fields, FieldError{"ids", fmt.Sprintf("%q is not a valid song id", id)})
+			}
+		}
+	}
+	if count > maxSongScoreIds {
+		fields = append(fields, FieldError{"ids", fmt.Sprintf("at most %d ids may be requested", maxSongScoreIds)})
+	}
+	return
+}
+
+// ValidateBatchRequest checks a batch request against the configured limits.
+// Sub-requests must target another route of the api, excluding batch itself.
+func ValidateBatchRequest(request BatchRequest) (fields []FieldError) {
+	if len(request.Requests) == 0 {
+		fields = append(fields, FieldError{"requests", "is required"})
+	}
+	if len(request.Requests) > utilities.BatchMaxRequests {
+		fields = append(fields, FieldError{"requests", fmt.Sprintf("at most %d requests may be batched", utilities.BatchMaxRequests)})
+	}
+
+	for i, item := range request.Requests {
+		prefix := fmt.Sprintf("requests[%d].", i)
+		fields = validateOneOf(fields, prefix+"method", item.Method, batchMethods)
+		fields = validateString(fields, prefix+"path", item.Path, true, 2048)
+
+		uri, err := url.Parse(item.Path)
+		switch {
+		case err != nil:
+			fields = append(fields, FieldError{prefix + "path", "must be a valid path"})
+		case !strings.HasPrefix(uri.Path, "/") || len(uri.Host) > 0 || len(uri.Scheme) > 0:
+			fields = append(fields, FieldError{prefix + "path", "must be an absolute path below the api"})
+		case strings.Contains(uri.Path, ".."):
+			fields = append(fields, FieldError{prefix + "path", "must not contain .."})
+		case batchExcluded(uri.Path):
+			fields = append(fields, FieldError{prefix + "path", "may not be batched"})
+		}
+
+		if len(item.Body) > 0 && item.Method == http.MethodGet {
+			fields = append(fields, FieldError{prefix + "body", "must be empty for GET requests"})
+		}
+	}
+	return
+}
+
+func batchExcluded(requestPath string) bool {
+	requestPath = strings.ToLower(path.Clean(requestPath))
+	for _, excluded := range batchExcludedPaths {
+		if requestPath == excluded || strings.HasPrefix(requestPath, excluded+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeValidationError responds with base extended by the given field errors.
+func writeValidationError(rw http.ResponseWriter, base bst_models.Error, fields []FieldError) {
+	bytes, _ := json.Marshal(ValidationError{
+		Error:  base,
+		Fields: fields,
+	})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(base.CorrespondingHttpCode)
+	rw.Write(bytes)
+}
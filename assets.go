@@ -0,0 +1,9 @@
+package main
+
+import "embed"
+
+// embeddedAssets holds the frontend build and page templates, so the binary
+// can be deployed on its own.
+//
+//go:embed dist templates
+var embeddedAssets embed.FS
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bst_web/utilities"
+	"encoding/json"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func AdminRouter() *mux.Router {
+	adminRouter := utilities.HandleRouterErrors(mux.NewRouter().PathPrefix("/admin").Subrouter())
+
+	adminRouter.HandleFunc("/audit", AdminAuditGet).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/crashes", AdminCrashesGet).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/caches", AdminCachesGet).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/invalidations", AdminInvalidationsGet).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/upstreams", AdminUpstreamsGet).Methods(http.MethodGet)
+
+	return adminRouter
+}
+
+// AdminAuditGet returns the audit log, optionally filtered by the `user`,
+// `from` and `to` query parameters. Times are expected in RFC 3339 format.
+func AdminAuditGet(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+
+	var from, to time.Time
+	var e error
+	if len(query.Get("from")) > 0 {
+		if from, e = time.Parse(time.RFC3339, query.Get("from")); e != nil {
+			utilities.RenderError(rw, r, bst_models.ErrorBadQuery)
+			return
+		}
+	}
+	if len(query.Get("to")) > 0 {
+		if to, e = time.Parse(time.RFC3339, query.Get("to")); e != nil {
+			utilities.RenderError(rw, r, bst_models.ErrorBadQuery)
+			return
+		}
+	}
+
+	utilities.Audit(r, utilities.AuditAdmin, utilities.AuditSuccess, "audit query " + r.URL.RawQuery)
+
+	events, e := utilities.QueryAudit(query.Get("user"), from, to)
+	if e != nil {
+		glog.Errorf("failed to query audit log: %v", e)
+		utilities.RenderError(rw, r, bst_models.ErrorBadRequest)
+		return
+	}
+
+	bytes, _ := json.Marshal(events)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(bytes)
+}
+
+// AdminCachesGet returns hit, miss and eviction counters of every cache.
+func AdminCachesGet(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	bytes, _ := json.Marshal(utilities.CacheStatistics())
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(bytes)
+}
+
+// AdminInvalidationsGet returns the most recently received cache
+// invalidation webhooks.
+func AdminInvalidationsGet(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	bytes, _ := json.Marshal(utilities.RecentInvalidations())
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(bytes)
+}
+
+// AdminUpstreamsGet returns health and request counters of every BST API
+// upstream.
+func AdminUpstreamsGet(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	bytes, _ := json.Marshal(utilities.UpstreamStatistics())
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(bytes)
+}
+
+// AdminCrashesGet returns the most recent recovered panics, newest first.
+// The number returned is set with the `limit` query parameter.
+func AdminCrashesGet(rw http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if len(r.URL.Query().Get("limit")) > 0 {
+		var e error
+		if limit, e = strconv.Atoi(r.URL.Query().Get("limit")); e != nil || limit <= 0 {
+			utilities.RenderError(rw, r, bst_models.ErrorBadQuery)
+			return
+		}
+	}
+
+	crashes, e := utilities.RecentCrashes(limit)
+	if e != nil {
+		glog.Errorf("failed to read crash log: %v", e)
+		utilities.RenderError(rw, r, bst_models.ErrorBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	bytes, _ := json.Marshal(crashes)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(bytes)
+}
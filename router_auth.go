@@ -18,4 +18,7 @@ func AttachAuthRoutes(r *mux.Router) {
 
 	r.Path("/logout").Handler(utilities.GetCommonMiddleware().With(
 		negroni.Wrap(http.HandlerFunc(utilities.LogoutHandler))))
+
+	r.Path(utilities.BackChannelLogoutPath).Handler(utilities.GetCommonMiddleware().With(
+		negroni.Wrap(http.HandlerFunc(utilities.BackChannelLogoutHandler)))).Methods(http.MethodPost)
 }
\ No newline at end of file
@@ -1,15 +1,15 @@
 package main
 
 import (
+	"bst_web/utilities"
 	"fmt"
 	"github.com/gorilla/mux"
-	"io/ioutil"
 	"net/http"
 )
 
 func DdrRouter() *mux.Router {
 	fmt.Println("Building ddr routes...")
-	ddrRouter := mux.NewRouter().PathPrefix("/ddr").Subrouter()
+	ddrRouter := utilities.HandleRouterErrors(mux.NewRouter().PathPrefix("/ddr").Subrouter())
 
 	ddrRouter.HandleFunc("", DdrIndex).Methods(http.MethodGet)
 	ddrRouter.HandleFunc("/stats", DdrStats).Methods(http.MethodGet)
@@ -19,13 +19,9 @@ func DdrRouter() *mux.Router {
 }
 
 func DdrIndex(rw http.ResponseWriter, r *http.Request) {
-	fileBytes, _ := ioutil.ReadFile("./dist/ddr/ddr.html")
-	rw.WriteHeader(200)
-	rw.Write(fileBytes)
+	utilities.RenderPage(rw, r, http.StatusOK, "ddr", utilities.PageData{Game: "ddr", Entry: "ddr/ddr.html"})
 }
 
 func DdrStats(rw http.ResponseWriter, r *http.Request) {
-	fileBytes, _ := ioutil.ReadFile("./dist/ddr/stats.html")
-	rw.WriteHeader(200)
-	rw.Write(fileBytes)
+	utilities.RenderPage(rw, r, http.StatusOK, "ddr_stats", utilities.PageData{Game: "ddr", Entry: "ddr/stats.html"})
 }
\ No newline at end of file
@@ -1,15 +1,15 @@
 package main
 
 import (
+	"bst_web/utilities"
 	"fmt"
 	"github.com/gorilla/mux"
-	"io/ioutil"
 	"net/http"
 )
 
 func DrsRouter() *mux.Router {
 	fmt.Println("Building drs routes...")
-	ddrRouter := mux.NewRouter().PathPrefix("/drs").Subrouter()
+	ddrRouter := utilities.HandleRouterErrors(mux.NewRouter().PathPrefix("/drs").Subrouter())
 
 	ddrRouter.HandleFunc("", DrsIndex).Methods(http.MethodGet)
 	ddrRouter.HandleFunc("/stats", DrsStats).Methods(http.MethodGet)
@@ -19,13 +19,9 @@ func DrsRouter() *mux.Router {
 }
 
 func DrsIndex(rw http.ResponseWriter, r *http.Request) {
-	fileBytes, _ := ioutil.ReadFile("./dist/drs/drs.html")
-	rw.WriteHeader(200)
-	rw.Write(fileBytes)
+	utilities.RenderPage(rw, r, http.StatusOK, "drs", utilities.PageData{Game: "drs", Entry: "drs/drs.html"})
 }
 
 func DrsStats(rw http.ResponseWriter, r *http.Request) {
-	fileBytes, _ := ioutil.ReadFile("./dist/drs/stats.html")
-	rw.WriteHeader(200)
-	rw.Write(fileBytes)
+	utilities.RenderPage(rw, r, http.StatusOK, "drs_stats", utilities.PageData{Game: "drs", Entry: "drs/stats.html"})
 }
\ No newline at end of file
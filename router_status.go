@@ -0,0 +1,14 @@
+package main
+
+import (
+	"bst_web/api_proxy"
+	"bst_web/utilities"
+	"net/http"
+)
+
+// StatusPage renders the public uptime page.
+func StatusPage(rw http.ResponseWriter, r *http.Request) {
+	utilities.RenderPage(rw, r, http.StatusOK, "status", utilities.PageData{
+		Data: api_proxy.CurrentStatusReport(),
+	})
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"bst_web/utilities"
 	"github.com/gorilla/mux"
-	"io/ioutil"
 	"net/http"
 )
 
 func UserRouter() *mux.Router {
-	userRouter := mux.NewRouter().PathPrefix("/user").Subrouter()
+	userRouter := utilities.HandleRouterErrors(mux.NewRouter().PathPrefix("/user").Subrouter())
 
 	userRouter.HandleFunc("", UserProfile).Methods(http.MethodGet)
 
@@ -15,7 +15,5 @@ func UserRouter() *mux.Router {
 }
 
 func UserProfile(rw http.ResponseWriter, r *http.Request) {
-	fileBytes, _ := ioutil.ReadFile("./dist/user/user.html")
-	rw.WriteHeader(200)
-	rw.Write(fileBytes)
+	utilities.RenderPage(rw, r, http.StatusOK, "user", utilities.PageData{Entry: "user/user.html"})
 }
\ No newline at end of file
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bst_web/utilities"
+	"encoding/json"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	maxWebhookBodySize = 4 * 1024
+)
+
+// InvalidationWebhook receives signed cache invalidation events from the
+// BST API.
+func InvalidationWebhook(rw http.ResponseWriter, r *http.Request) {
+	record := utilities.InvalidationRecord{
+		Time:    time.Now().UTC(),
+		Outcome: utilities.AuditFailure,
+	}
+	defer func() {
+		utilities.RecordInvalidation(record)
+	}()
+
+	defer r.Body.Close()
+	body, e := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, maxWebhookBodySize))
+	if e != nil {
+		record.Detail = "unreadable body"
+		http.Error(rw, record.Detail, http.StatusBadRequest)
+		return
+	}
+
+	if e := utilities.VerifyWebhookSignature(r.Header.Get(utilities.SignatureHeader), r.Method, r.URL.RequestURI(), body); e != nil {
+		glog.Warningf("rejected invalidation webhook from %s: %v", utilities.ClientIp(r), e)
+		record.Detail = e.Error()
+		http.Error(rw, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := utilities.InvalidationEvent{}
+	if e := json.Unmarshal(body, &event); e != nil {
+		record.Detail = "malformed event"
+		http.Error(rw, record.Detail, http.StatusBadRequest)
+		return
+	}
+	record.Id = event.Id
+	record.Type = event.Type
+	record.User = event.User
+
+	if e := utilities.ApplyInvalidation(event); e != nil {
+		record.Detail = e.Error()
+		http.Error(rw, record.Detail, http.StatusConflict)
+		return
+	}
+
+	record.Outcome = utilities.AuditSuccess
+	rw.WriteHeader(http.StatusNoContent)
+}
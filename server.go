@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bst_web/api_proxy"
 	"bst_web/utilities"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -10,34 +12,72 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 	"golang.org/x/crypto/acme/autocert"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
-	utilities.LoadConfig()
+	if err := utilities.LoadConfig(); err != nil {
+		log.Fatal(err)
+	}
 	utilities.PrepareMiddleware()
 
-	utilities.InitStore()
-	utilities.InitClient()
-	utilities.CreateCaches()
+	if err := utilities.InitAuditLog(); err != nil {
+		log.Fatal(err)
+	}
+	if err := utilities.InitCrashLog(); err != nil {
+		log.Fatal(err)
+	}
 
-	r := mux.NewRouter()
+	utilities.InitStore()
+	if err := utilities.InitClient(); err != nil {
+		log.Fatal(err)
+	}
+	if err := utilities.InitUpstreams(); err != nil {
+		log.Fatal(err)
+	}
+	if err := utilities.InitCanary(); err != nil {
+		log.Fatal(err)
+	}
+	if err := utilities.CreateCaches(); err != nil {
+		log.Fatal(err)
+	}
+	utilities.RestoreCaches()
+	api_proxy.StartStatusPoller(utilities.StatusInterval, utilities.StatusRetention)
+	utilities.StartCacheSnapshots(utilities.CacheSnapshotInterval)
+	utilities.StartThrottleJanitor(10 * time.Minute)
+	utilities.PageStatus = api_proxy.CurrentStatus
+	if err := utilities.InitAssets(embeddedAssets); err != nil {
+		log.Fatal(err)
+	}
+	if err := utilities.BuildAssetManifest(); err != nil {
+		log.Fatal(err)
+	}
+	if err := utilities.BuildPrecompressed(); err != nil {
+		log.Fatal(err)
+	}
+	if err := utilities.InitMedia(); err != nil {
+		log.Fatal(err)
+	}
+	if err := utilities.LoadTemplates(); err != nil {
+		log.Fatal(err)
+	}
 
+	r := utilities.HandleRouterErrors(mux.NewRouter())
 
-	r.NotFoundHandler = http.HandlerFunc(utilities.NotFoundMiddleware)
 
 	r.Path("/{path:.*\\.js$}").Handler(utilities.GetCommonMiddleware().With(
 		negroni.HandlerFunc(SetContentType("application/javascript")),
 		negroni.Wrap(utilities.GetCachingMiddleware().With(
-			negroni.Wrap(http.FileServer(http.Dir(utilities.StaticDirectory)))))))
+			negroni.Wrap(utilities.StaticFileServer())))))
 
 	// SUB-ROUTERS
 	r.PathPrefix("/external").Handler(utilities.GetCommonMiddleware().With(
+		negroni.HandlerFunc(utilities.CompressResponses),
 		negroni.Wrap(CreateExternalRouters("", nil))))
 
 	r.PathPrefix("/user").Handler(utilities.GetCommonMiddleware().With(
@@ -52,15 +92,42 @@ func main() {
 		negroni.Wrap(utilities.GetProtectionMiddleware().With(
 		negroni.Wrap(DrsRouter())))))
 
+	r.PathPrefix("/admin").Handler(utilities.GetCommonMiddleware().With(
+		negroni.Wrap(utilities.GetAdminMiddleware().With(
+			negroni.Wrap(AdminRouter())))))
+
 	AttachAuthRoutes(r)
 
+	if len(utilities.CspReportPath) > 0 {
+		r.Path(utilities.CspReportPath).Handler(utilities.GetCommonMiddleware().With(
+			negroni.Wrap(http.HandlerFunc(utilities.CspReportHandler)))).Methods(http.MethodPost)
+		utilities.StartCspReportLogger(time.Minute)
+	}
+
+	r.Path("/webhook/invalidate").Handler(utilities.GetCommonMiddleware().With(
+		negroni.Wrap(http.HandlerFunc(InvalidationWebhook)))).Methods(http.MethodPost)
+
 	r.Path("/whoami").Handler(utilities.GetCommonMiddleware().With(
 		negroni.Wrap(http.HandlerFunc(WhoAmI)))).Methods(http.MethodGet)
 	r.Path("/clearcache").Handler(utilities.GetCommonMiddleware().With(
-		negroni.Wrap(http.HandlerFunc(ClearCache)))).Methods(http.MethodGet)
+		negroni.Wrap(utilities.GetAdminMiddleware().With(
+			negroni.Wrap(http.HandlerFunc(ClearCache)))))).Methods(http.MethodGet)
+	r.Path("/canary/optin").Handler(utilities.GetCommonMiddleware().With(
+		negroni.Wrap(utilities.GetProtectionMiddleware().With(
+			negroni.Wrap(http.HandlerFunc(utilities.CanaryOptIn)))))).Methods(http.MethodPost)
+	r.Path("/canary/optout").Handler(utilities.GetCommonMiddleware().With(
+		negroni.Wrap(http.HandlerFunc(utilities.CanaryOptOut)))).Methods(http.MethodPost)
+	r.Path("/status").Handler(utilities.GetCommonMiddleware().With(
+		negroni.Wrap(http.HandlerFunc(StatusPage)))).Methods(http.MethodGet)
 	r.Path("/help").Handler(utilities.GetCommonMiddleware().With(
 		negroni.Wrap(http.HandlerFunc(HelpPage)))).Methods(http.MethodGet)
 
+	if utilities.DevMode {
+		r.Path("/dev/livereload").Handler(utilities.GetCommonMiddleware().With(
+			negroni.Wrap(http.HandlerFunc(utilities.LiveReloadHandler)))).Methods(http.MethodGet)
+		utilities.StartDevWatcher(utilities.DevPollInterval)
+	}
+
 	r.Path("/token").Handler(utilities.GetCommonMiddleware().With(
 		negroni.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 			session, _ := utilities.Store.Get(r, "auth-session")
@@ -72,15 +139,18 @@ func main() {
 
 	r.PathPrefix(utilities.MediaDirectory).Handler(utilities.GetCommonMiddleware().With(
 		negroni.HandlerFunc(SetMediaContentType),
-		negroni.Wrap(http.FileServer(http.Dir(utilities.StaticDirectory)))))
+		negroni.Wrap(utilities.GetCachingMiddleware().With(
+			negroni.HandlerFunc(utilities.ImageVariants),
+			negroni.Wrap(utilities.StaticFileServer())))))
 
 	r.PathPrefix(utilities.CssDirectory).Handler(utilities.GetCommonMiddleware().With(
 		negroni.HandlerFunc(SetContentType("text/css")),
-		negroni.Wrap(http.FileServer(http.Dir(utilities.StaticDirectory)))))
+		negroni.Wrap(utilities.GetCachingMiddleware().With(
+			negroni.Wrap(utilities.StaticFileServer())))))
 
 	r.PathPrefix("/").Handler(utilities.GetCommonMiddleware().With(
 		negroni.HandlerFunc(utilities.RedirectHomeMiddleware),
-		negroni.Wrap(http.HandlerFunc(IndexHandler(utilities.StaticDirectory+utilities.IndexPage)))))
+		negroni.Wrap(http.HandlerFunc(IndexHandler(utilities.IndexPage)))))
 
 	var certManager *autocert.Manager
 
@@ -91,7 +161,7 @@ func main() {
 	}
 
 	srv := &http.Server{
-		Handler:           r,
+		Handler:           utilities.NormalizePaths(r),
 		Addr:		":" + utilities.ServePort,
 		ReadTimeout: 15 * time.Second,
 		WriteTimeout: 90 * time.Second,
@@ -100,18 +170,45 @@ func main() {
 		},
 	}
 
-	go func() {
-		// serve HTTP, which will redirect automatically to HTTPS
-		h := certManager.HTTPHandler(nil)
-		log.Fatal(http.ListenAndServe(":http", h))
-	}()
+	if utilities.DevMode {
+		// plain HTTP without write timeout, so live reload streams stay open
+		srv.WriteTimeout = 0
+		go func() {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	} else {
+		go func() {
+			// serve HTTP, which will redirect automatically to HTTPS
+			h := certManager.HTTPHandler(nil)
+			log.Fatal(http.ListenAndServe(":http", h))
+		}()
+
+		go func() {
+			if err := srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
 
-	log.Fatal(srv.ListenAndServeTLS("", ""))
+	glog.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		glog.Errorf("graceful shutdown failed: %v", err)
+	}
+	utilities.SnapshotCaches()
+	glog.Flush()
 }
 
 func IndexHandler(entrypoint string) func(w http.ResponseWriter, r *http.Request) {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, entrypoint)
+		utilities.ServeStaticFile(w, r, entrypoint)
 	}
 	return fn
 }
@@ -124,7 +221,9 @@ func SetContentType(contentType string) func(rw http.ResponseWriter, r *http.Req
 }
 
 func SetMediaContentType(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-
+	if contentType := utilities.MediaType(r.URL.Path); len(contentType) > 0 {
+		rw.Header().Set("Content-Type", contentType)
+	}
 	next(rw, r)
 }
 
@@ -135,6 +234,13 @@ func OpenResource(path string, resource string) func(rw http.ResponseWriter, r *
 	}
 }
 
+// WhoAmIResponse is the cached user along with the name of the BST API
+// upstream serving them.
+type WhoAmIResponse struct {
+	bst_models.UserCache
+	Upstream string `json:"upstream"`
+}
+
 func WhoAmI(rw http.ResponseWriter, r *http.Request) {
 	session, err := utilities.Store.Get(r, "auth-session")
 	rw.Header().Set("Content-Type", "application/json")
@@ -153,22 +259,17 @@ func WhoAmI(rw http.ResponseWriter, r *http.Request) {
 	if ok {
 		sub, ok := profileMap["sub"].(string)
 		if ok {
-			sub = strings.ToLower(sub)
-			cacheResult := utilities.GetCacheValue("users", sub)
-			if cacheResult == nil {
-				glog.Infof("cache not found for %s. Loading from api", sub)
-				LoadUserCache(sub)
-				cacheResult = utilities.GetCacheValue("users", sub)
-				if cacheResult == nil {
-					glog.Warningf("cache still could not be found for %s", sub)
-					rw.WriteHeader(http.StatusUnauthorized)
-					rw.Write([]byte("{}"))
-					return
-				}
+			userCache, ok := api_proxy.UserCacheFor(r.Context(), sub)
+			if !ok {
+				rw.WriteHeader(http.StatusUnauthorized)
+				rw.Write([]byte("{}"))
+				return
 			}
 
-			userCache := cacheResult.(bst_models.UserCache)
-			user, _ := json.Marshal(userCache)
+			user, _ := json.Marshal(WhoAmIResponse{
+				UserCache: userCache,
+				Upstream:  utilities.UpstreamNameForRequest(r),
+			})
 			rw.WriteHeader(http.StatusOK)
 			rw.Write(user)
 			return
@@ -181,38 +282,12 @@ func WhoAmI(rw http.ResponseWriter, r *http.Request) {
 }
 
 func HelpPage(rw http.ResponseWriter, r *http.Request) {
-	fileBytes, _ := ioutil.ReadFile("./dist/general/help.html")
-	rw.WriteHeader(200)
-	rw.Write(fileBytes)
-}
-
-func LoadUserCache(user string) bool {
-	glog.Infof("loading cache for user %s", user)
-	uri, _ := url.Parse("https://" + utilities.BstApi + utilities.BstApiBase + "cache")
-
-	query := uri.Query()
-	query.Set("user", user)
-	uri.RawQuery = query.Encode()
-
-	req := &http.Request{
-		Method:           http.MethodGet,
-		URL:              uri,
-	}
-
-	res, err := utilities.GetClient().Do(req)
-	if err != nil {
-		return false
-	}
-
-	cacheData := bst_models.UserCache{}
-	json.NewDecoder(res.Body).Decode(&cacheData)
-
-	glog.Infof("%s cache loaded, user id %d", user, cacheData.Id)
-	return utilities.SetCacheValue("users", user, cacheData)
+	utilities.RenderPage(rw, r, http.StatusOK, "help", utilities.PageData{})
 }
 
 func ClearCache(rw http.ResponseWriter, r *http.Request) {
 	utilities.ClearCache()
+	utilities.Audit(r, utilities.AuditAdmin, utilities.AuditSuccess, "clear cache")
 	rw.WriteHeader(http.StatusOK)
 	rw.Write([]byte(""))
 	return
@@ -0,0 +1,166 @@
+package utilities
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/golang/glog"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	assetHashLength      = 12
+	immutableCacheHeader = "public, max-age=31536000, immutable"
+)
+
+// asset is a static file known to the manifest.
+type asset struct {
+	path string
+	url  string
+	etag string
+}
+
+// assetManifest maps static files to their content-hash urls and ETags.
+type assetManifest struct {
+	sync.RWMutex
+	byPath map[string]asset
+	byUrl  map[string]asset
+}
+
+var (
+	assets assetManifest
+)
+
+// BuildAssetManifest hashes every file of StaticFiles. Files below the js,
+// css and media directories are additionally given a url containing their
+// content hash, e.g. /js/ddr.3f2a9c0b1d4e.js, which may be cached forever.
+func BuildAssetManifest() error {
+	byPath := make(map[string]asset)
+	byUrl := make(map[string]asset)
+
+	err := fs.WalkDir(StaticFiles, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		hash, err := hashStaticFile(name)
+		if err != nil {
+			return err
+		}
+
+		a := asset{
+			path: "/" + name,
+			url:  "/" + name,
+			etag: "\"" + hash[:32] + "\"",
+		}
+		if fingerprinted(a.path) {
+			ext := path.Ext(a.path)
+			a.url = strings.TrimSuffix(a.path, ext) + "." + hash[:assetHashLength] + ext
+			byUrl[a.url] = a
+		}
+		byPath[a.path] = a
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	assets.Lock()
+	assets.byPath = byPath
+	assets.byUrl = byUrl
+	assets.Unlock()
+	glog.Infof("asset manifest built, %d files, %d fingerprinted", len(byPath), len(byUrl))
+	return nil
+}
+
+func hashStaticFile(name string) (string, error) {
+	f, err := StaticFiles.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func fingerprinted(name string) bool {
+	for _, dir := range []string{JavascriptDirectory, CssDirectory, MediaDirectory} {
+		if strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// AssetUrl returns the content-hash url of the static file at name, or name
+// itself when the file is not fingerprinted.
+func AssetUrl(name string) string {
+	assets.RLock()
+	defer assets.RUnlock()
+	if a, ok := assets.byPath[name]; ok {
+		return a.url
+	}
+	return name
+}
+
+// lookupAsset finds the asset served at url, reporting whether url is a
+// content-hash url.
+func lookupAsset(url string) (a asset, hashed bool, ok bool) {
+	assets.RLock()
+	defer assets.RUnlock()
+	if a, ok = assets.byUrl[url]; ok {
+		return a, true, true
+	}
+	a, ok = assets.byPath[url]
+	return a, false, ok
+}
+
+// FileCacher serves content-hash urls from their underlying file with an
+// immutable cache lifetime. Other static files must be revalidated and are
+// answered with a 304 when their content hash ETag still matches.
+func FileCacher(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	a, hashed, ok := lookupAsset(path.Clean(r.URL.Path))
+	if !ok {
+		next(rw, r)
+		return
+	}
+	if hashed {
+		r = withPath(r, a.path)
+	}
+	if DevMode {
+		next(rw, r)
+		return
+	}
+
+	rw.Header().Set("ETag", a.etag)
+	// also on 304s, which are answered before PrecompressedFiles runs
+	addVary(rw.Header(), "Accept-Encoding")
+	if hashed {
+		rw.Header().Set("Cache-Control", immutableCacheHeader)
+	} else {
+		rw.Header().Set("Cache-Control", "public, no-cache")
+	}
+	if ETagMatches(r, a.etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	next(rw, r)
+}
+
+// withPath returns a shallow copy of r requesting path instead.
+func withPath(r *http.Request, path string) *http.Request {
+	clone := new(http.Request)
+	*clone = *r
+	url := *r.URL
+	url.Path = path
+	url.RawPath = ""
+	clone.URL = &url
+	return clone
+}
@@ -0,0 +1,85 @@
+package utilities
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	embeddedStaticDirectory   = "dist"
+	embeddedTemplateDirectory = "templates"
+)
+
+var (
+	// StaticFiles serves the frontend build, TemplateFiles the page
+	// templates. Both are embedded unless overridden from disk.
+	StaticFiles   fs.FS
+	TemplateFiles fs.FS
+)
+
+// InitAssets serves static files and templates from the embedded
+// filesystem, or from disk when -static or -templates are given. It fails
+// when the index page is missing, e.g. when the frontend was not built
+// before the binary.
+func InitAssets(embedded fs.FS) (err error) {
+	if StaticFiles, err = assetFS(embedded, embeddedStaticDirectory, StaticDirectory); err != nil {
+		return
+	}
+	if _, err = fs.Stat(StaticFiles, strings.TrimPrefix(path.Clean("/"+IndexPage), "/")); err != nil {
+		return fmt.Errorf("index page %s not found in static files, was the frontend built into dist/? %w", IndexPage, err)
+	}
+	TemplateFiles, err = assetFS(embedded, embeddedTemplateDirectory, TemplateDirectory)
+	return
+}
+
+func assetFS(embedded fs.FS, dir string, override string) (fs.FS, error) {
+	if len(override) > 0 {
+		glog.Infof("serving %s from disk at %s", dir, override)
+		return os.DirFS(override), nil
+	}
+	if DevMode {
+		glog.Warningf("serving embedded %s in dev mode, changes will not be picked up", dir)
+	}
+	return fs.Sub(embedded, dir)
+}
+
+// StaticFileServer serves StaticFiles at the request path. Directories are
+// not found rather than redirected to a trailing slash, which NormalizePaths
+// would redirect back.
+func StaticFileServer() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ServeStaticFile(rw, r, r.URL.Path)
+	})
+}
+
+// ServeStaticFile writes the named file of StaticFiles, honouring
+// conditional and range requests.
+func ServeStaticFile(rw http.ResponseWriter, r *http.Request, name string) {
+	f, err := StaticFiles.Open(strings.TrimPrefix(path.Clean("/"+name), "/"))
+	if err != nil {
+		NotFoundMiddleware(rw, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		NotFoundMiddleware(rw, r)
+		return
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if a, _, ok := lookupAsset(path.Clean("/" + name)); ok && !DevMode {
+		rw.Header().Set("ETag", a.etag)
+	}
+	http.ServeContent(rw, r, info.Name(), info.ModTime(), content)
+}
@@ -0,0 +1,294 @@
+package utilities
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"github.com/golang/glog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit actions recorded in the security audit log.
+const (
+	AuditLogin              = "login"
+	AuditLogout             = "logout"
+	AuditBackChannelLogout  = "backchannel_logout"
+	AuditTokenRefreshFailed = "token_refresh"
+	AuditEagateLogin        = "eagate_login"
+	AuditEagateLogout       = "eagate_logout"
+	AuditEagateLockout      = "eagate_lockout"
+	AuditBstUserUpdate      = "bstuser_update"
+	AuditProfileRefresh     = "profile_refresh"
+	AuditProfileUpdate      = "profile_update"
+	AuditAdmin              = "admin"
+	AuditCanary             = "canary"
+)
+
+// Audit outcomes.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+const (
+	maxAuditLine      = 64 * 1024
+	maxAuditUserAgent = 512
+	maxAuditDetail    = 2048
+)
+
+// AuditEvent is a single line of the audit log.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Sub       string    `json:"sub"`
+	Ip        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+type auditLog struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+var (
+	auditLogger *auditLog
+)
+
+// InitAuditLog opens the append-only audit log configured by the
+// `auditlog` flags.
+func InitAuditLog() error {
+	if err := os.MkdirAll(filepath.Dir(auditLogPath), 0700); err != nil {
+		return err
+	}
+
+	auditLogger = &auditLog{
+		path:    auditLogPath,
+		maxSize: int64(auditLogMaxSize) * 1024 * 1024,
+		backups: auditLogBackups,
+	}
+	return auditLogger.open()
+}
+
+func (l *auditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate shifts audit.log.N-1 to audit.log.N, dropping the oldest backup,
+// and starts a fresh log file.
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	for i := l.backups; i > 0; i-- {
+		from := l.path + "." + strconv.Itoa(i-1)
+		if i == 1 {
+			from = l.path
+		}
+		to := l.path + "." + strconv.Itoa(i)
+		if i == l.backups {
+			os.Remove(to)
+		}
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if l.backups == 0 {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+func (l *auditLog) write(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		glog.Errorf("failed to encode audit event: %v", err)
+		return
+	}
+	if err := l.writeLine(line); err != nil {
+		glog.Errorf("failed to write audit event: %v", err)
+	}
+}
+
+// writeLine appends line to the log, rotating it first when the line would
+// grow it beyond maxSize.
+func (l *auditLog) writeLine(line []byte) error {
+	line = append(line, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate %s: %v", l.path, err)
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// paths returns the rotated logs followed by the current one, oldest first.
+func (l *auditLog) paths() []string {
+	paths := make([]string, 0, l.backups+1)
+	for i := l.backups; i > 0; i-- {
+		paths = append(paths, l.path+"."+strconv.Itoa(i))
+	}
+	return append(paths, l.path)
+}
+
+// snapshot opens the rotated logs and the current one, oldest first. The
+// files are opened under the lock, so a rotation cannot move them between
+// opens, and may then be read without blocking writes.
+func (l *auditLog) snapshot() ([]*os.File, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	files := make([]*os.File, 0, l.backups+1)
+	for _, path := range l.paths() {
+		file, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Audit records an action performed on behalf of the session user of the
+// request.
+func Audit(r *http.Request, action string, outcome string, detail string) {
+	AuditSub(r, SubForRequest(r), action, outcome, detail)
+}
+
+// AuditSub records an action performed on behalf of the given user.
+func AuditSub(r *http.Request, sub string, action string, outcome string, detail string) {
+	if auditLogger == nil {
+		return
+	}
+
+	auditLogger.write(AuditEvent{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Sub:       sub,
+		Ip:        ClientIp(r),
+		UserAgent: truncate(r.UserAgent(), maxAuditUserAgent),
+		Outcome:   outcome,
+		Detail:    truncate(detail, maxAuditDetail),
+	})
+}
+
+// AuditOutcome maps an api error to an audit outcome.
+func AuditOutcome(err bst_models.Error) string {
+	if err.Equals(bst_models.ErrorOK) {
+		return AuditSuccess
+	}
+	return AuditFailure
+}
+
+// QueryAudit returns all audit events matching the given user and falling
+// within [from, to]. Empty or zero values are not filtered on. Rotated
+// backups are searched as well, oldest first.
+func QueryAudit(sub string, from time.Time, to time.Time) (events []AuditEvent, err error) {
+	events = make([]AuditEvent, 0)
+	if auditLogger == nil {
+		return
+	}
+
+	files, err := auditLogger.snapshot()
+	if err != nil {
+		return
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 4096), maxAuditLine)
+		scanner.Split(skipLongLines(maxAuditLine))
+		for scanner.Scan() {
+			event := AuditEvent{}
+			if json.Unmarshal(scanner.Bytes(), &event) != nil {
+				continue
+			}
+			if len(sub) > 0 && !strings.EqualFold(event.Sub, sub) {
+				continue
+			}
+			if !from.IsZero() && event.Time.Before(from) {
+				continue
+			}
+			if !to.IsZero() && event.Time.After(to) {
+				continue
+			}
+			events = append(events, event)
+		}
+		if err = scanner.Err(); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// skipLongLines splits like bufio.ScanLines, but drops lines of max bytes or
+// more rather than failing the scan with bufio.ErrTooLong.
+func skipLongLines(max int) bufio.SplitFunc {
+	skipping := false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if skipping {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				skipping = false
+				return i + 1, nil, nil
+			}
+			return len(data), nil, nil
+		}
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance == 0 && err == nil && len(data) >= max {
+			skipping = true
+			return len(data), nil, nil
+		}
+		return advance, token, err
+	}
+}
+
+// ClientIp returns the remote address of the request without its port.
+func ClientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
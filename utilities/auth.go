@@ -6,9 +6,11 @@ import (
 	"encoding/base64"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	bst_models "github.com/chris-sg/bst_server_models"
 	"github.com/coreos/go-oidc"
+	"github.com/golang/glog"
 	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
 	"io/ioutil"
@@ -20,6 +22,11 @@ import (
 	"time"
 )
 
+const (
+	sessionStorePath = "./store"
+	backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+)
+
 var (
 	Store *sessions.FilesystemStore
 )
@@ -32,7 +39,7 @@ type Authenticator struct {
 
 // InitStore will ensure a store for auth data exists.
 func InitStore() error {
-	Store = sessions.NewFilesystemStore("./store", []byte(fileStoreKey))
+	Store = sessions.NewFilesystemStore(sessionStorePath, []byte(fileStoreKey))
 	gob.Register(map[string]interface{}{})
 	return nil
 }
@@ -72,6 +79,7 @@ func CallbackHandler(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.URL.Query().Get("state") != session.Values["state"] {
+		AuditSub(r, "", AuditLogin, AuditFailure, "invalid state parameter")
 		http.Error(rw, "Invalid state parameter", http.StatusBadRequest)
 		return
 	}
@@ -85,6 +93,7 @@ func CallbackHandler(rw http.ResponseWriter, r *http.Request) {
 	token, err := authenticator.Config.Exchange(context.TODO(), r.URL.Query().Get("code"))
 	if err != nil {
 		log.Printf("no token found: %v", err)
+		AuditSub(r, "", AuditLogin, AuditFailure, "token exchange failed")
 		rw.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -108,6 +117,7 @@ func CallbackHandler(rw http.ResponseWriter, r *http.Request) {
 	idToken, err := authenticator.Provider.Verifier(oidcConfig).Verify(context.TODO(), rawIDToken)
 
 	if err != nil {
+		AuditSub(r, "", AuditLogin, AuditFailure, "id token verification failed")
 		http.Error(rw, "Failed to verify ID Token: " + err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -129,6 +139,9 @@ func CallbackHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sub, _ := profile["sub"].(string)
+	AuditSub(r, sub, AuditLogin, AuditSuccess, "")
+
 	// Redirect to logged in page
 	http.Redirect(rw, r, "/user", http.StatusSeeOther)
 }
@@ -166,7 +179,9 @@ func LoginHandler(rw http.ResponseWriter, r *http.Request) {
 	http.Redirect(rw, r, authenticator.Config.AuthCodeURL(state, oauth2.AccessTypeOffline), http.StatusTemporaryRedirect)
 }
 
-// Logout will remove a users login state.
+// LogoutHandler will remove a users login state. The local session and its
+// store file are destroyed and any cached user data is evicted before the
+// user is redirected to the authorization server to end the remote session.
 func LogoutHandler(rw http.ResponseWriter, r *http.Request) {
 	logoutUrl, err := url.Parse(authClientIssuer)
 
@@ -175,6 +190,20 @@ func LogoutHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	session, err := Store.Get(r, "auth-session")
+	if err == nil && !session.IsNew {
+		if profile, ok := session.Values["profile"].(map[string]interface{}); ok {
+			if sub, ok := profile["sub"].(string); ok {
+				EvictUserCaches(sub)
+				AuditSub(r, sub, AuditLogout, AuditSuccess, "")
+			}
+		}
+		session.Options.MaxAge = -1
+		if err := session.Save(r, rw); err != nil {
+			glog.Warningf("failed to destroy session %s: %v", session.ID, err)
+		}
+	}
+
 	logoutUrl.Path += "v2/logout"
 	parameters := url.Values{}
 
@@ -197,6 +226,99 @@ func LogoutHandler(rw http.ResponseWriter, r *http.Request) {
 	http.Redirect(rw, r, logoutUrl.String(), http.StatusTemporaryRedirect)
 }
 
+// BackChannelLogoutHandler receives OIDC back-channel logout requests from the
+// authorization server. The logout token is validated and every local session
+// matching its `sub` or `sid` is destroyed.
+func BackChannelLogoutHandler(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Cache-Control", "no-store")
+
+	rawLogoutToken := r.PostFormValue("logout_token")
+	if len(rawLogoutToken) == 0 {
+		http.Error(rw, "missing logout_token", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := verifyLogoutToken(rawLogoutToken)
+	if err != nil {
+		glog.Warningf("rejected back-channel logout token: %v", err)
+		AuditSub(r, "", AuditBackChannelLogout, AuditFailure, err.Error())
+		http.Error(rw, "invalid logout_token", http.StatusBadRequest)
+		return
+	}
+
+	if len(claims.Sub) > 0 {
+		EvictUserCaches(claims.Sub)
+	}
+	removed, err := RevokeSessions(claims.Sub, claims.Sid)
+	if err != nil {
+		glog.Errorf("back-channel logout for sub %s sid %s failed: %v", claims.Sub, claims.Sid, err)
+		AuditSub(r, claims.Sub, AuditBackChannelLogout, AuditFailure, err.Error())
+		http.Error(rw, "failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	glog.Infof("back-channel logout for sub %s sid %s removed %d sessions", claims.Sub, claims.Sid, removed)
+	AuditSub(r, claims.Sub, AuditBackChannelLogout, AuditSuccess, fmt.Sprintf("%d sessions removed", removed))
+	rw.WriteHeader(http.StatusOK)
+}
+
+type logoutTokenClaims struct {
+	Sub    string                 `json:"sub"`
+	Sid    string                 `json:"sid"`
+	Jti    string                 `json:"jti"`
+	Nonce  *string                `json:"nonce"`
+	Events map[string]interface{} `json:"events"`
+}
+
+// verifyLogoutToken validates a back-channel logout token as described by
+// OpenID Connect Back-Channel Logout 1.0, section 2.6.
+func verifyLogoutToken(rawLogoutToken string) (claims logoutTokenClaims, err error) {
+	authenticator, err := NewAuthenticator()
+	if err != nil {
+		return
+	}
+
+	oidcConfig := &oidc.Config{
+		ClientID: authClientId,
+	}
+
+	token, err := authenticator.Provider.Verifier(oidcConfig).Verify(context.TODO(), rawLogoutToken)
+	if err != nil {
+		return
+	}
+
+	if err = token.Claims(&claims); err != nil {
+		return
+	}
+
+	if _, ok := claims.Events[backChannelLogoutEvent]; !ok {
+		err = errors.New("logout token is missing the back-channel logout event")
+		return
+	}
+	if claims.Nonce != nil {
+		err = errors.New("logout token must not contain a nonce")
+		return
+	}
+	if len(claims.Sub) == 0 && len(claims.Sid) == 0 {
+		err = errors.New("logout token contains neither sub nor sid")
+		return
+	}
+	if len(claims.Jti) == 0 {
+		err = errors.New("logout token is missing jti")
+		return
+	}
+	if GetCacheValue("logout_tokens", claims.Jti) != nil {
+		err = errors.New("logout token has already been used")
+		return
+	}
+	if !SetCacheValue("logout_tokens", claims.Jti, true) {
+		err = errors.New("replay protection requires a logout_tokens cache")
+		return
+	}
+
+	return
+}
+
 // RefreshJwt will send a refresh request to the designated authorization server
 // in case expiry is near.
 func RefreshJwt(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
@@ -206,17 +328,19 @@ func RefreshJwt(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc)
 		return
 	}
 
-	if session.Values["profile"] == nil {
+	expTime, iat, ok := profileTimes(session)
+	if !ok {
 		next(rw, r)
 		return
 	}
 
-	profile := session.Values["profile"].(map[string]interface{})
-	expTime := time.Unix(int64(profile["exp"].(float64)), 0)
-	iat := time.Unix(int64(profile["iat"].(float64)), 0)
 	buffer := (expTime.Unix() - iat.Unix()) / 10
 	if expTime.Unix() < time.Now().Add(time.Second * time.Duration(buffer)).Unix() {
-		refreshToken := session.Values["refresh_token"].(string)
+		refreshToken, ok := session.Values["refresh_token"].(string)
+		if !ok {
+			next(rw, r)
+			return
+		}
 		authEndpoint, err := url.Parse(authClientIssuer + "oauth/token")
 
 		data := url.Values{
@@ -229,7 +353,13 @@ func RefreshJwt(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc)
 		req, _ := http.NewRequest(http.MethodPost, authEndpoint.String(), strings.NewReader(data.Encode()))
 		req.Header.Add("content-type", "application/x-www-form-urlencoded")
 		req.Header.Add("content-length", strconv.Itoa(len(data.Encode())))
-		res, _ := http.DefaultClient.Do(req)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Println(err)
+			Audit(r, AuditTokenRefreshFailed, AuditFailure, err.Error())
+			next(rw, r)
+			return
+		}
 
 		defer res.Body.Close()
 		body, _ := ioutil.ReadAll(res.Body)
@@ -238,12 +368,14 @@ func RefreshJwt(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc)
 		err = json.Unmarshal(body, &responseMap)
 		if err != nil {
 			fmt.Println(err)
+			Audit(r, AuditTokenRefreshFailed, AuditFailure, err.Error())
 			next(rw, r)
 			return
 		}
 
 		rawIDToken, ok := responseMap["id_token"].(string)
 		if !ok {
+			Audit(r, AuditTokenRefreshFailed, AuditFailure, "no id_token in refresh response")
 			http.Error(rw, "No id_token field in oauth2 token.", http.StatusInternalServerError)
 			return
 		}
@@ -255,6 +387,7 @@ func RefreshJwt(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc)
 		authenticator, err := NewAuthenticator()
 		if err != nil {
 			fmt.Println(err)
+			Audit(r, AuditTokenRefreshFailed, AuditFailure, err.Error())
 			next(rw, r)
 			return
 		}
@@ -263,6 +396,7 @@ func RefreshJwt(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc)
 
 		if err != nil {
 			fmt.Println(err)
+			Audit(r, AuditTokenRefreshFailed, AuditFailure, err.Error())
 			next(rw, r)
 			return
 		}
@@ -270,6 +404,7 @@ func RefreshJwt(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc)
 		var updatedProfile map[string]interface{}
 		if err := idToken.Claims(&updatedProfile); err != nil {
 			fmt.Println(err)
+			Audit(r, AuditTokenRefreshFailed, AuditFailure, err.Error())
 			next(rw, r)
 			return
 		}
@@ -281,6 +416,7 @@ func RefreshJwt(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc)
 		err = session.Save(r, rw)
 		if err != nil {
 			fmt.Println(err)
+			Audit(r, AuditTokenRefreshFailed, AuditFailure, err.Error())
 			next(rw, r)
 			return
 		}
@@ -303,9 +439,9 @@ func LogoutIfExpired(rw http.ResponseWriter, r *http.Request, next http.HandlerF
 		return
 	}
 
-	profile := session.Values["profile"].(map[string]interface{})
-	expTime := time.Unix(int64(profile["exp"].(float64)), 0)
-	if expTime.Unix() < time.Now().Unix() {
+	// a malformed session is treated like an expired one
+	expTime, _, ok := profileTimes(session)
+	if !ok || expTime.Unix() < time.Now().Unix() {
 		cookie := &http.Cookie {
 			Name:    "auth-session",
 			Value:   "",
@@ -332,10 +468,46 @@ func TokenForRequest(r *http.Request) (token string, err bst_models.Error) {
 		return
 	}
 
-	token = session.Values["id_token"].(string)
+	token, ok := session.Values["id_token"].(string)
+	if !ok {
+		err = bst_models.ErrorJwt
+	}
 	return
 }
 
+// profileTimes returns the expiry and issue time of the session profile. It
+// returns false when the profile is missing or malformed, in which case the
+// session is to be treated as logged out.
+func profileTimes(session *sessions.Session) (expires time.Time, issued time.Time, ok bool) {
+	profile, ok := session.Values["profile"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	exp, expOk := profile["exp"].(float64)
+	iat, iatOk := profile["iat"].(float64)
+	if !expOk || !iatOk {
+		return expires, issued, false
+	}
+	return time.Unix(int64(exp), 0), time.Unix(int64(iat), 0), true
+}
+
+// SubForRequest retrieves the users sub, or an empty string when the request
+// has no authenticated session.
+func SubForRequest(r *http.Request) string {
+	profile, err := ProfileForRequest(r)
+	if !err.Equals(bst_models.ErrorOK) {
+		return ""
+	}
+	sub, _ := profile["sub"].(string)
+	return sub
+}
+
+// IsAdmin reports whether the session user of the request has admin access.
+func IsAdmin(r *http.Request) bool {
+	sub := SubForRequest(r)
+	return len(sub) > 0 && adminSubs[strings.ToLower(sub)]
+}
+
 func ProfileForRequest(r *http.Request) (profile map[string]interface{}, err bst_models.Error) {
 	err = bst_models.ErrorOK
 	session, e := Store.Get(r, "auth-session")
@@ -0,0 +1,121 @@
+package utilities
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Cache backends available to named caches.
+const (
+	CacheBackendMemory = "memory"
+	CacheBackendDisk   = "disk"
+	CacheBackendRedis  = "redis"
+)
+
+// Cache is implemented by every cache backend. A ttl of 0 passed to Set uses
+// the default ttl of the cache.
+type Cache interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{}, ttl time.Duration)
+	Delete(key string)
+	Flush()
+	Stats() CacheStats
+}
+
+// CacheConfig declares a named cache.
+type CacheConfig struct {
+	Name    string
+	Backend string
+	Ttl     time.Duration
+	MaxSize int
+}
+
+// CacheStats are the counters kept for every cache. Entries is -1 when the
+// backend cannot cheaply tell how many entries it holds.
+type CacheStats struct {
+	Name        string `json:"name"`
+	Backend     string `json:"backend"`
+	Entries     int    `json:"entries"`
+	MaxSize     int    `json:"max_size"`
+	Hits        int64  `json:"hits"`
+	Misses      int64  `json:"misses"`
+	Sets        int64  `json:"sets"`
+	Evictions   int64  `json:"evictions"`
+	Expirations int64  `json:"expirations"`
+}
+
+type cacheCounters struct {
+	hits        int64
+	misses      int64
+	sets        int64
+	evictions   int64
+	expirations int64
+}
+
+func (c *cacheCounters) hit()    { atomic.AddInt64(&c.hits, 1) }
+func (c *cacheCounters) miss()   { atomic.AddInt64(&c.misses, 1) }
+func (c *cacheCounters) set()    { atomic.AddInt64(&c.sets, 1) }
+func (c *cacheCounters) evict()  { atomic.AddInt64(&c.evictions, 1) }
+func (c *cacheCounters) expire() { atomic.AddInt64(&c.expirations, 1) }
+
+func (c *cacheCounters) stats(config CacheConfig, entries int) CacheStats {
+	return CacheStats{
+		Name:        config.Name,
+		Backend:     config.Backend,
+		Entries:     entries,
+		MaxSize:     config.MaxSize,
+		Hits:        atomic.LoadInt64(&c.hits),
+		Misses:      atomic.LoadInt64(&c.misses),
+		Sets:        atomic.LoadInt64(&c.sets),
+		Evictions:   atomic.LoadInt64(&c.evictions),
+		Expirations: atomic.LoadInt64(&c.expirations),
+	}
+}
+
+// NewCache creates the backend described by config.
+func NewCache(config CacheConfig) (Cache, error) {
+	switch config.Backend {
+	case CacheBackendMemory:
+		return newMemoryCache(config), nil
+	case CacheBackendDisk:
+		return newDiskCache(config, cacheDirectory)
+	case CacheBackendRedis:
+		return newRedisCache(config, redisAddress, redisPassword, redisDatabase), nil
+	}
+	return nil, fmt.Errorf("unknown cache backend %q for cache %s", config.Backend, config.Name)
+}
+
+// ParseCacheConfigs parses the `caches` flag. Caches are separated by commas
+// and declared as name:backend:ttl:maxsize, e.g. "users:memory:15m:10000".
+func ParseCacheConfigs(spec string) (configs []CacheConfig, err error) {
+	for _, declaration := range strings.Split(spec, ",") {
+		declaration = strings.TrimSpace(declaration)
+		if len(declaration) == 0 {
+			continue
+		}
+
+		parts := strings.Split(declaration, ":")
+		if len(parts) != 4 {
+			err = fmt.Errorf("cache declaration %q must be name:backend:ttl:maxsize", declaration)
+			return
+		}
+
+		config := CacheConfig{
+			Name:    parts[0],
+			Backend: parts[1],
+		}
+		if config.Ttl, err = time.ParseDuration(parts[2]); err != nil {
+			err = fmt.Errorf("cache %s: %v", config.Name, err)
+			return
+		}
+		if config.MaxSize, err = strconv.Atoi(parts[3]); err != nil {
+			err = fmt.Errorf("cache %s: %v", config.Name, err)
+			return
+		}
+		configs = append(configs, config)
+	}
+	return
+}
@@ -0,0 +1,200 @@
+package utilities
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// diskCache persists each entry as a gob encoded file below
+// <cachedir>/<cache name>. Values must be registered with gob.
+type diskCache struct {
+	sync.Mutex
+	config   CacheConfig
+	dir      string
+	tempDir  string
+	entries  int
+	counters cacheCounters
+}
+
+type diskEntry struct {
+	Key     string
+	Expires time.Time
+	Value   interface{}
+}
+
+func newDiskCache(config CacheConfig, root string) (*diskCache, error) {
+	dir := filepath.Join(root, config.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// files are written here, outside of dir, and renamed into it
+	tempDir := filepath.Join(root, "."+config.Name+".tmp")
+	if err := os.MkdirAll(tempDir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskCache{
+		config:  config,
+		dir:     dir,
+		tempDir: tempDir,
+		entries: len(files),
+	}, nil
+}
+
+func (c *diskCache) filename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *diskCache) Get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	filename := c.filename(key)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		c.counters.miss()
+		return nil, false
+	}
+
+	entry := diskEntry{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil || entry.Key != key {
+		c.counters.miss()
+		return nil, false
+	}
+
+	if !entry.Expires.IsZero() && time.Now().After(entry.Expires) {
+		c.removeFile(filename)
+		c.counters.expire()
+		c.counters.miss()
+		return nil, false
+	}
+
+	c.counters.hit()
+	return entry.Value, true
+}
+
+func (c *diskCache) Set(key string, value interface{}, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = c.config.Ttl
+	}
+	entry := diskEntry{
+		Key:   key,
+		Value: value,
+	}
+	if ttl > 0 {
+		entry.Expires = time.Now().Add(ttl)
+	}
+
+	buffer := bytes.Buffer{}
+	if err := gob.NewEncoder(&buffer).Encode(&entry); err != nil {
+		glog.Errorf("failed to encode value for disk cache %s: %v", c.config.Name, err)
+		return
+	}
+
+	// the file is written without the lock, which is only held to move it
+	// into place
+	temp, err := ioutil.TempFile(c.tempDir, "entry")
+	if err != nil {
+		glog.Errorf("failed to write disk cache %s: %v", c.config.Name, err)
+		return
+	}
+	_, err = temp.Write(buffer.Bytes())
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		glog.Errorf("failed to write disk cache %s: %v", c.config.Name, err)
+		os.Remove(temp.Name())
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.counters.set()
+
+	filename := c.filename(key)
+	_, statErr := os.Stat(filename)
+
+	if err := os.Rename(temp.Name(), filename); err != nil {
+		glog.Errorf("failed to write disk cache %s: %v", c.config.Name, err)
+		os.Remove(temp.Name())
+		return
+	}
+
+	if os.IsNotExist(statErr) {
+		c.entries++
+	}
+	if c.config.MaxSize > 0 && c.entries > c.config.MaxSize {
+		c.evictOldest()
+	}
+}
+
+// evictOldest removes the least recently written entries until the cache is
+// within its size bound. Callers must hold the lock.
+func (c *diskCache) evictOldest() {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	c.entries = len(files)
+	for _, file := range files {
+		if c.entries <= c.config.MaxSize {
+			break
+		}
+		c.removeFile(filepath.Join(c.dir, file.Name()))
+		c.counters.evict()
+	}
+}
+
+func (c *diskCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	c.removeFile(c.filename(key))
+}
+
+func (c *diskCache) Flush() {
+	c.Lock()
+	defer c.Unlock()
+
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		c.removeFile(filepath.Join(c.dir, file.Name()))
+	}
+	c.entries = 0
+}
+
+func (c *diskCache) Stats() CacheStats {
+	c.Lock()
+	entries := c.entries
+	c.Unlock()
+	return c.counters.stats(c.config, entries)
+}
+
+// removeFile deletes a cache file. Callers must hold the lock.
+func (c *diskCache) removeFile(filename string) {
+	if err := os.Remove(filename); err == nil && c.entries > 0 {
+		c.entries--
+	}
+}
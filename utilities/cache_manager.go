@@ -1,18 +1,117 @@
 package utilities
 
 import (
+	"encoding/gob"
 	"github.com/golang/glog"
-	"github.com/patrickmn/go-cache"
-	"time"
+	"sort"
+)
+
+// LastKnownGoodCache holds the last successful response of every user for
+// each response cache, served while the BST API is unavailable.
+const (
+	LastKnownGoodCache = "last_known_good"
+	cacheWriteQueue    = 256
 )
 
 var (
-	caches map[string]*cache.Cache
+	caches map[string]Cache
+
+	// internalCaches back features rather than responses and are created
+	// with these declarations when `caches` leaves them out.
+	internalCaches = []string{
+		"logout_tokens:memory:24h:100000",
+		"webhook_events:memory:15m:100000",
+		LastKnownGoodCache + ":disk:168h:5000",
+	}
+
+	// replayCaches remember what has already been accepted and are kept by
+	// ClearCache, as flushing them would allow replays.
+	replayCaches = map[string]bool{
+		"logout_tokens":  true,
+		"webhook_events": true,
+	}
+
+	// cacheWrites are applied in order by a single goroutine, keeping slow
+	// writes, e.g. to disk, out of the request path.
+	cacheWrites = make(chan cacheWrite, cacheWriteQueue)
 )
 
-func CreateCaches() {
-	caches = make(map[string]*cache.Cache)
-	caches["users"] = cache.New(15*time.Minute, 20*time.Minute)
+// cacheWrite sets value for key, or deletes key when value is nil.
+type cacheWrite struct {
+	cacheName string
+	key       string
+	value     interface{}
+}
+
+// CreateCaches builds every named cache declared by the `caches` flag.
+func CreateCaches() error {
+	for _, t := range snapshotTypes {
+		gob.Register(t)
+	}
+
+	configs, err := ParseCacheConfigs(cacheDeclarations)
+	if err != nil {
+		return err
+	}
+	declared := make(map[string]bool)
+	for _, config := range configs {
+		declared[config.Name] = true
+	}
+	for _, declaration := range internalCaches {
+		defaults, err := ParseCacheConfigs(declaration)
+		if err != nil {
+			return err
+		}
+		if !declared[defaults[0].Name] {
+			glog.Infof("cache %s not declared, using %s", defaults[0].Name, declaration)
+			configs = append(configs, defaults[0])
+		}
+	}
+
+	caches = make(map[string]Cache)
+	for _, config := range configs {
+		c, err := NewCache(config)
+		if err != nil {
+			return err
+		}
+		caches[config.Name] = c
+		glog.Infof("created %s cache %s, ttl %s, max size %d", config.Backend, config.Name, config.Ttl, config.MaxSize)
+	}
+	go applyCacheWrites()
+	return nil
+}
+
+// SetCacheValueAsync stores value in the background. Writes are dropped when
+// too many are pending.
+func SetCacheValueAsync(cacheName string, key string, value interface{}) {
+	select {
+	case cacheWrites <- cacheWrite{cacheName, key, value}:
+	default:
+		glog.Warningf("dropped write to cache %s, too many pending", cacheName)
+	}
+}
+
+// clearCacheValueQueued deletes key now and again after pending background
+// writes, so a write queued before the delete cannot restore the value.
+func clearCacheValueQueued(cacheName string, key string) {
+	ClearCacheValue(cacheName, key)
+	cacheWrites <- cacheWrite{cacheName: cacheName, key: key}
+}
+
+func applyCacheWrites() {
+	for write := range cacheWrites {
+		if write.value == nil {
+			ClearCacheValue(write.cacheName, write.key)
+			continue
+		}
+		SetCacheValue(write.cacheName, write.key, write.value)
+	}
+}
+
+// LastKnownGoodKey is the key of the last known good response of the user
+// cached under key in the named cache.
+func LastKnownGoodKey(cacheName string, key string) string {
+	return cacheName + ":" + key
 }
 
 func ClearCacheValue(cacheName string, key string) {
@@ -22,28 +121,58 @@ func ClearCacheValue(cacheName string, key string) {
 }
 
 func GetCacheValue(cacheName string, key string) interface{} {
-	glog.Infof("finding key %s in cache %s", key, cacheName)
 	if cacheObject, exists := caches[cacheName]; exists && cacheObject != nil {
-		glog.Infof("cache %s found", cacheName)
 		if value, found := cacheObject.Get(key); found {
 			return value
 		}
+		glog.V(2).Infof("key %s not found in cache %s", key, cacheName)
+		return nil
 	}
-	glog.Infof("cache %s not found", cacheName)
+	glog.Warningf("cache %s not found", cacheName)
 	return nil
 }
 
 func SetCacheValue(cacheName string, key string, value interface{}) bool {
 	if cacheObject, exists := caches[cacheName]; exists && cacheObject != nil {
-		cacheObject.Set(key, value, cache.DefaultExpiration)
+		cacheObject.Set(key, value, 0)
 		return true
 	}
 
 	return false
 }
 
+// EvictUserCaches removes all cached data held for the given user, including
+// their last known good responses.
+func EvictUserCaches(sub string) {
+	for _, cacheNames := range invalidationTargets {
+		for _, cacheName := range cacheNames {
+			ClearCacheValue(cacheName, sub)
+			for _, key := range userCacheKeys(sub) {
+				ClearCacheValue(cacheName, key)
+				clearCacheValueQueued(LastKnownGoodCache, LastKnownGoodKey(cacheName, key))
+			}
+		}
+	}
+}
+
+// ClearCache flushes every cache except the replay caches.
 func ClearCache() {
-	for _, cache := range caches {
+	for name, cache := range caches {
+		if replayCaches[name] {
+			continue
+		}
 		cache.Flush()
 	}
-}
\ No newline at end of file
+}
+
+// CacheStatistics returns the counters of every cache, ordered by name.
+func CacheStatistics() []CacheStats {
+	stats := make([]CacheStats, 0, len(caches))
+	for _, cache := range caches {
+		stats = append(stats, cache.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
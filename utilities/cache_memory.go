@@ -0,0 +1,143 @@
+package utilities
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// memoryCache is a size bounded in-memory LRU cache. A MaxSize of 0 leaves
+// the cache unbounded.
+type memoryCache struct {
+	sync.Mutex
+	config   CacheConfig
+	items    map[string]*list.Element
+	order    *list.List
+	counters cacheCounters
+}
+
+type memoryEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newMemoryCache(config CacheConfig) *memoryCache {
+	c := &memoryCache{
+		config: config,
+		items:  make(map[string]*list.Element),
+		order:  list.New(),
+	}
+
+	interval := config.Ttl / 2
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	go c.janitor(interval)
+
+	return c
+}
+
+func (c *memoryCache) Get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		c.counters.miss()
+		return nil, false
+	}
+
+	entry := element.Value.(*memoryEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(element)
+		c.counters.expire()
+		c.counters.miss()
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	c.counters.hit()
+	return entry.value, true
+}
+
+func (c *memoryCache) Set(key string, value interface{}, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = c.config.Ttl
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	c.setWithExpiry(key, value, expires)
+}
+
+func (c *memoryCache) setWithExpiry(key string, value interface{}, expires time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.counters.set()
+
+	if element, ok := c.items[key]; ok {
+		entry := element.Value.(*memoryEntry)
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&memoryEntry{
+		key:     key,
+		value:   value,
+		expires: expires,
+	})
+
+	for c.config.MaxSize > 0 && c.order.Len() > c.config.MaxSize {
+		c.remove(c.order.Back())
+		c.counters.evict()
+	}
+}
+
+func (c *memoryCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *memoryCache) Flush() {
+	c.Lock()
+	defer c.Unlock()
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+func (c *memoryCache) Stats() CacheStats {
+	c.Lock()
+	entries := c.order.Len()
+	c.Unlock()
+	return c.counters.stats(c.config, entries)
+}
+
+// remove drops element from the cache. Callers must hold the lock.
+func (c *memoryCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.items, element.Value.(*memoryEntry).key)
+}
+
+func (c *memoryCache) janitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.Lock()
+		now := time.Now()
+		for element := c.order.Back(); element != nil; {
+			previous := element.Prev()
+			entry := element.Value.(*memoryEntry)
+			if !entry.expires.IsZero() && now.After(entry.expires) {
+				c.remove(element)
+				c.counters.expire()
+			}
+			element = previous
+		}
+		c.Unlock()
+	}
+}
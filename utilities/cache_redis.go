@@ -0,0 +1,305 @@
+package utilities
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisPoolSize     = 16
+	redisDialTimeout  = 500 * time.Millisecond
+	redisTimeout      = time.Second
+	redisRetryBackoff = 5 * time.Second
+)
+
+var (
+	errRedisUnavailable = errors.New("redis: unavailable, retrying later")
+)
+
+// redisCache stores gob encoded values in any server speaking the Redis
+// protocol. Keys are prefixed with bst_web:<cache name>: so several caches
+// can share one database. Size bounds are left to the servers maxmemory
+// policy, so MaxSize is informational only.
+//
+// Commands run concurrently on a small pool of connections. When the server
+// cannot be reached, commands fail at once for redisRetryBackoff instead of
+// each waiting for a dial, so callers fall back to a miss quickly.
+type redisCache struct {
+	config   CacheConfig
+	address  string
+	password string
+	database int
+	prefix   string
+	idle     chan *redisConn
+	counters cacheCounters
+
+	downLock  sync.Mutex
+	downUntil time.Time
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisEntry struct {
+	Value interface{}
+}
+
+func newRedisCache(config CacheConfig, address string, password string, database int) *redisCache {
+	return &redisCache{
+		config:   config,
+		address:  address,
+		password: password,
+		database: database,
+		prefix:   "bst_web:" + config.Name + ":",
+		idle:     make(chan *redisConn, redisPoolSize),
+	}
+}
+
+func (c *redisCache) Get(key string) (interface{}, bool) {
+	reply, err := c.do("GET", c.prefix+key)
+	data, ok := reply.([]byte)
+	if err != nil || !ok {
+		if err != nil {
+			glog.Warningf("redis cache %s get failed: %v", c.config.Name, err)
+		}
+		c.counters.miss()
+		return nil, false
+	}
+
+	entry := redisEntry{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		c.counters.miss()
+		return nil, false
+	}
+
+	c.counters.hit()
+	return entry.Value, true
+}
+
+func (c *redisCache) Set(key string, value interface{}, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = c.config.Ttl
+	}
+
+	buffer := bytes.Buffer{}
+	if err := gob.NewEncoder(&buffer).Encode(&redisEntry{Value: value}); err != nil {
+		glog.Errorf("failed to encode value for redis cache %s: %v", c.config.Name, err)
+		return
+	}
+
+	c.counters.set()
+	args := []string{"SET", c.prefix + key, buffer.String()}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+	if _, err := c.do(args...); err != nil {
+		glog.Warningf("redis cache %s set failed: %v", c.config.Name, err)
+	}
+}
+
+func (c *redisCache) Delete(key string) {
+	if _, err := c.do("DEL", c.prefix+key); err != nil {
+		glog.Warningf("redis cache %s delete failed: %v", c.config.Name, err)
+	}
+}
+
+// Flush removes every key of this cache, leaving other data in the database
+// untouched.
+func (c *redisCache) Flush() {
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", c.prefix+"*", "COUNT", "500")
+		if err != nil {
+			glog.Warningf("redis cache %s flush failed: %v", c.config.Name, err)
+			return
+		}
+
+		result, ok := reply.([]interface{})
+		if !ok || len(result) != 2 {
+			return
+		}
+		next, _ := result[0].([]byte)
+		keys, _ := result[1].([]interface{})
+
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, key := range keys {
+				if k, ok := key.([]byte); ok {
+					args = append(args, string(k))
+				}
+			}
+			c.do(args...)
+		}
+
+		cursor = string(next)
+		if cursor == "0" || len(cursor) == 0 {
+			return
+		}
+	}
+}
+
+func (c *redisCache) Stats() CacheStats {
+	return c.counters.stats(c.config, -1)
+}
+
+// do sends a single command and returns its reply, retrying once on a new
+// connection when a pooled one has gone away.
+func (c *redisCache) do(args ...string) (reply interface{}, err error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *redisConn
+		if conn, err = c.get(); err != nil {
+			return
+		}
+
+		reply, err = conn.roundTrip(args)
+		if err == nil {
+			c.put(conn)
+			return
+		}
+		if _, isServerError := err.(redisError); isServerError {
+			c.put(conn)
+			return
+		}
+		conn.conn.Close()
+	}
+	return
+}
+
+// get returns an idle connection, or dials a new one unless the server was
+// recently unreachable.
+func (c *redisCache) get() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	c.downLock.Lock()
+	down := time.Now().Before(c.downUntil)
+	c.downLock.Unlock()
+	if down {
+		return nil, errRedisUnavailable
+	}
+
+	conn, err := c.connect()
+	if err != nil {
+		c.downLock.Lock()
+		c.downUntil = time.Now().Add(redisRetryBackoff)
+		c.downLock.Unlock()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// put returns a connection to the pool, closing it when the pool is full.
+func (c *redisCache) put(conn *redisConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// connect dials the server and authenticates.
+func (c *redisCache) connect() (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", c.address, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+
+	if len(c.password) > 0 {
+		if _, err := conn.roundTrip([]string{"AUTH", c.password}); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	if c.database != 0 {
+		if _, err := conn.roundTrip([]string{"SELECT", strconv.Itoa(c.database)}); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *redisConn) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	buffer := bytes.Buffer{}
+	fmt.Fprintf(&buffer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buffer, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write(buffer.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.reader)
+}
+
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errors.New("redis: unknown reply type")
+}
@@ -0,0 +1,233 @@
+package utilities
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"github.com/golang/glog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheSnapshotFormat is bumped whenever the snapshot layout itself changes.
+const cacheSnapshotFormat = 1
+
+var (
+	// snapshotTypes lists every type stored in caches. Their structure is part
+	// of the snapshot version, so a change to any of them invalidates existing
+	// snapshots instead of restoring data of the wrong shape.
+	snapshotTypes = []interface{}{
+		bst_models.UserCache{},
+		CachedResponse{},
+	}
+
+	// snapshotLock serializes snapshots, which the periodic snapshots and
+	// the one taken on shutdown would otherwise write to the same files.
+	snapshotLock sync.Mutex
+)
+
+// CacheItem is a single cache entry with its absolute expiry.
+type CacheItem struct {
+	Key     string
+	Value   interface{}
+	Expires time.Time
+}
+
+// Snapshotter is implemented by caches that lose their contents on restart.
+type Snapshotter interface {
+	Snapshot() []CacheItem
+	Restore(items []CacheItem) int
+}
+
+type cacheSnapshot struct {
+	Version string
+	Cache   string
+	Created time.Time
+	Items   []CacheItem
+}
+
+func (c *memoryCache) Snapshot() []CacheItem {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	items := make([]CacheItem, 0, c.order.Len())
+	// oldest first, so restoring preserves the LRU order
+	for element := c.order.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*memoryEntry)
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			continue
+		}
+		items = append(items, CacheItem{
+			Key:     entry.key,
+			Value:   entry.value,
+			Expires: entry.expires,
+		})
+	}
+	return items
+}
+
+func (c *memoryCache) Restore(items []CacheItem) (restored int) {
+	now := time.Now()
+	for _, item := range items {
+		if !item.Expires.IsZero() && now.After(item.Expires) {
+			continue
+		}
+		c.setWithExpiry(item.Key, item.Value, item.Expires)
+		restored++
+	}
+	return
+}
+
+// SnapshotVersion identifies the snapshot format and the structure of every
+// cached type.
+func SnapshotVersion() string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "format %d\n", cacheSnapshotFormat)
+	for _, t := range snapshotTypes {
+		describeType(hash, reflect.TypeOf(t), make(map[reflect.Type]bool))
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+func describeType(w interface{ Write([]byte) (int, error) }, t reflect.Type, seen map[reflect.Type]bool) {
+	fmt.Fprintf(w, "%s.%s %s\n", t.PkgPath(), t.Name(), t.Kind())
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			fmt.Fprintf(w, "%s %q ", field.Name, field.Tag)
+			describeType(w, field.Type, seen)
+		}
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		describeType(w, t.Elem(), seen)
+	case reflect.Map:
+		describeType(w, t.Key(), seen)
+		describeType(w, t.Elem(), seen)
+	}
+}
+
+func snapshotFilename(name string) string {
+	return filepath.Join(cacheSnapshotDirectory, name+".snapshot")
+}
+
+// SnapshotCaches writes every snapshot capable cache to disk.
+func SnapshotCaches() {
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+
+	if err := os.MkdirAll(cacheSnapshotDirectory, 0700); err != nil {
+		glog.Errorf("failed to create cache snapshot directory: %v", err)
+		return
+	}
+
+	version := SnapshotVersion()
+	for name, cache := range caches {
+		snapshotter, ok := cache.(Snapshotter)
+		if !ok {
+			continue
+		}
+		if err := writeSnapshot(name, version, snapshotter.Snapshot()); err != nil {
+			glog.Errorf("failed to snapshot cache %s: %v", name, err)
+		}
+	}
+}
+
+func writeSnapshot(name string, version string, items []CacheItem) error {
+	filename := snapshotFilename(name)
+	temp := filename + ".tmp"
+
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(file).Encode(&cacheSnapshot{
+		Version: version,
+		Cache:   name,
+		Created: time.Now(),
+		Items:   items,
+	})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, filename)
+}
+
+// RestoreCaches loads the snapshots written by SnapshotCaches. Expired
+// entries and snapshots of a different version are discarded.
+func RestoreCaches() {
+	version := SnapshotVersion()
+	for name, cache := range caches {
+		snapshotter, ok := cache.(Snapshotter)
+		if !ok {
+			continue
+		}
+
+		snapshot, err := readSnapshot(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			glog.Warningf("discarding unreadable snapshot of cache %s: %v", name, err)
+			os.Remove(snapshotFilename(name))
+			continue
+		}
+		if snapshot.Version != version || snapshot.Cache != name {
+			glog.Warningf("discarding snapshot of cache %s with version %s, expected %s for %s", name, snapshot.Version, version, registeredTypeNames())
+			os.Remove(snapshotFilename(name))
+			continue
+		}
+
+		restored := snapshotter.Restore(snapshot.Items)
+		glog.Infof("restored %d of %d entries of cache %s from snapshot taken %s", restored, len(snapshot.Items), name, snapshot.Created.Format(time.RFC3339))
+	}
+}
+
+func readSnapshot(name string) (snapshot cacheSnapshot, err error) {
+	file, err := os.Open(snapshotFilename(name))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	err = gob.NewDecoder(file).Decode(&snapshot)
+	return
+}
+
+// StartCacheSnapshots periodically snapshots caches. An interval of 0
+// disables periodic snapshots.
+func StartCacheSnapshots(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			SnapshotCaches()
+		}
+	}()
+}
+
+// registeredTypeNames is used in log output when snapshot versions differ.
+func registeredTypeNames() string {
+	names := make([]string, 0, len(snapshotTypes))
+	for _, t := range snapshotTypes {
+		names = append(names, reflect.TypeOf(t).String())
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,189 @@
+package utilities
+
+import (
+	"context"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"github.com/golang/glog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type upstreamContextKey struct{}
+
+var (
+	canaryUpstreams *UpstreamPool
+)
+
+// InitCanary creates the alternate upstream pool used for canary users. It
+// is a no-op when `canaryapi` is not set.
+func InitCanary() (err error) {
+	if len(canaryApiHosts) == 0 {
+		return
+	}
+	canaryUpstreams, err = NewUpstreamPool("canary", canaryApiHosts, upstreamStrategy)
+	if err != nil {
+		return
+	}
+	canaryUpstreams.StartHealthChecks(upstreamCheckInterval)
+	return
+}
+
+// CanaryRouting routes BST API calls made while serving the request to the
+// canary upstreams when the session user is a tester, i.e. listed in
+// `canarysubs` or holding `canaryrole`, or has opted in through the canary
+// cookie. With `canaryoptin` any logged in user may opt in, otherwise only
+// testers. Opting out through the cookie keeps testers on the primary
+// upstreams.
+func CanaryRouting(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if canaryUpstreams == nil {
+		next(rw, r)
+		return
+	}
+
+	choice := ""
+	if cookie, e := r.Cookie(canaryCookieName); e == nil {
+		choice = cookie.Value
+	}
+	if choice == "0" {
+		next(rw, r)
+		return
+	}
+
+	reason := canaryTester(r)
+	if len(reason) == 0 && choice == "1" && canaryOptIn && len(SubForRequest(r)) > 0 {
+		reason = "cookie"
+	}
+	if len(reason) == 0 {
+		next(rw, r)
+		return
+	}
+
+	glog.V(1).Infof("routing %s %s to canary upstream (%s)", r.Method, r.URL.Path, reason)
+	next(rw, r.WithContext(context.WithValue(r.Context(), upstreamContextKey{}, canaryUpstreams)))
+}
+
+// canaryTester returns why the session user may use the canary upstreams,
+// or an empty string if they may not.
+func canaryTester(r *http.Request) string {
+	profile, err := ProfileForRequest(r)
+	if !err.Equals(bst_models.ErrorOK) {
+		return ""
+	}
+	sub, _ := profile["sub"].(string)
+	if len(sub) == 0 {
+		return ""
+	}
+
+	if canarySubs[strings.ToLower(sub)] {
+		return "sub"
+	}
+	if len(canaryRole) > 0 {
+		if roles, ok := profile[roleClaim].([]interface{}); ok {
+			for _, role := range roles {
+				if role == canaryRole {
+					return "role"
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// upstreamPoolFor returns the pool BST API calls made with ctx are sent to.
+func upstreamPoolFor(ctx context.Context) *UpstreamPool {
+	if pool, ok := ctx.Value(upstreamContextKey{}).(*UpstreamPool); ok {
+		return pool
+	}
+	return upstreams
+}
+
+// UpstreamNameForRequest names the upstream pool serving the request.
+func UpstreamNameForRequest(r *http.Request) string {
+	pool := upstreamPoolFor(r.Context())
+	if pool == nil {
+		return ""
+	}
+	return pool.name
+}
+
+// UserCacheKey returns the key data of the user fetched with ctx is cached
+// under. Data fetched from the canary upstreams is kept apart from data of the
+// primary ones, so opting in or out never serves the other's data.
+func UserCacheKey(ctx context.Context, sub string) string {
+	key := strings.ToLower(sub)
+	if pool := upstreamPoolFor(ctx); len(key) > 0 && pool != nil && pool != upstreams {
+		key += "@" + pool.name
+	}
+	return key
+}
+
+// ClearUserCacheValue drops the data of the user from the named cache, for
+// every upstream pool.
+func ClearUserCacheValue(cacheName string, sub string) {
+	for _, key := range userCacheKeys(sub) {
+		ClearCacheValue(cacheName, key)
+	}
+}
+
+// userCacheKeys returns the keys data of the user may be cached under.
+func userCacheKeys(sub string) []string {
+	key := strings.ToLower(sub)
+	if canaryUpstreams == nil {
+		return []string{key}
+	}
+	return []string{key, key + "@" + canaryUpstreams.name}
+}
+
+// CanaryOptIn routes the user to the canary upstreams, or a tester again
+// after opting out. Users who are not testers are refused unless
+// `canaryoptin` is set.
+func CanaryOptIn(rw http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		RenderError(rw, r, ErrorUnauthorized)
+		return
+	}
+	if len(canaryTester(r)) == 0 && !canaryOptIn {
+		Audit(r, AuditCanary, AuditFailure, "opt in by non tester")
+		RenderError(rw, r, ErrorUnauthorized)
+		return
+	}
+	setCanaryCookie(rw, "1", time.Now().Add(30*24*time.Hour))
+	Audit(r, AuditCanary, AuditSuccess, "opt in")
+	http.Redirect(rw, r, "/whoami", http.StatusSeeOther)
+}
+
+// CanaryOptOut keeps the user on the primary upstreams.
+func CanaryOptOut(rw http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		RenderError(rw, r, ErrorUnauthorized)
+		return
+	}
+	setCanaryCookie(rw, "0", time.Now().Add(30*24*time.Hour))
+	Audit(r, AuditCanary, AuditSuccess, "opt out")
+	http.Redirect(rw, r, "/whoami", http.StatusSeeOther)
+}
+
+// sameOrigin reports whether a state changing request was sent by a page of
+// this site, judged by its Origin or, failing that, its Referer header.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		origin = r.Header.Get("Referer")
+	}
+	u, e := url.Parse(origin)
+	return e == nil && len(origin) > 0 && u.Host == r.Host
+}
+
+func setCanaryCookie(rw http.ResponseWriter, value string, expires time.Time) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     canaryCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
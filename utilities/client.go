@@ -1,24 +1,171 @@
 package utilities
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// SignatureHeader carries the HMAC signature of upstream requests.
+	SignatureHeader = "X-Bst-Signature"
+)
+
 var (
 	bstApiClient *http.Client
 )
 
-func InitClient() {
+// InitClient prepares the client used for all BST API calls. Depending on
+// configuration it presents a client certificate, trusts a custom CA pool,
+// pins the server certificate and signs every request.
+func InitClient() error {
+	tlsConfig, err := apiTlsConfig()
+	if err != nil {
+		return err
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	transport = &upstreamTransport{
+		next: transport,
+	}
+	if len(apiSigningKey) > 0 {
+		transport = &signingTransport{
+			key:  []byte(apiSigningKey),
+			next: transport,
+		}
+	}
+
 	bstApiClient = &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 		Jar:           nil,
 		Timeout:       time.Second * 60,
+		Transport:     transport,
 	}
+	return nil
 }
 
 func GetClient() *http.Client {
 	return bstApiClient
-}
\ No newline at end of file
+}
+
+func apiTlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(apiClientCert) > 0 || len(apiClientKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(apiClientCert, apiClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load api client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(apiCaFile) > 0 {
+		pem, err := ioutil.ReadFile(apiCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read api ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("api ca file contained no certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(apiPins) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range strings.Split(apiPins, ",") {
+			pins[strings.TrimSpace(pin)] = true
+		}
+		tlsConfig.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(verifiedChains) == 0 {
+				return errors.New("api certificate was not verified")
+			}
+			for _, chain := range verifiedChains {
+				// the root is only pinned when the server certificate is itself trusted
+				if len(chain) > 1 {
+					chain = chain[:len(chain)-1]
+				}
+				for _, cert := range chain {
+					if pins[CertificatePin(cert)] {
+						return nil
+					}
+				}
+			}
+			return errors.New("api certificate did not match any pinned key")
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// CertificatePin returns the base64 encoded sha256 hash of the certificates
+// subject public key info, the form expected by the `apipin` flag.
+func CertificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signingTransport adds an HMAC signature over the timestamp, method, path
+// with query and body hash to every request, allowing the BST API to verify requests
+// originate from this server.
+type signingTransport struct {
+	key  []byte
+	next http.RoundTripper
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signed := req.Clone(req.Context())
+	if signed.Header == nil {
+		signed.Header = make(http.Header)
+	}
+	if body != nil {
+		signed.Body = ioutil.NopCloser(bytes.NewReader(body))
+		signed.ContentLength = int64(len(body))
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signed.Header.Set(SignatureHeader, "t="+timestamp+",v1="+SignRequest(t.key, timestamp, req.Method, req.URL.RequestURI(), body))
+
+	return t.next.RoundTrip(signed)
+}
+
+// SignRequest computes the hex encoded request signature:
+// HMAC-SHA256(key, timestamp + "\n" + method + "\n" + requestUri + "\n" + hex(sha256(body))),
+// where requestUri is the escaped path followed by the raw query, if any.
+func SignRequest(key []byte, timestamp string, method string, requestUri string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + requestUri + "\n" + hex.EncodeToString(bodyHash[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
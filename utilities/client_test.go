@@ -0,0 +1,144 @@
+package utilities
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClientCertificate creates a self signed client certificate and key in
+// dir and returns their paths along with the certificate.
+func writeClientCertificate(t *testing.T, dir string) (certFile string, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bst_web"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestClientAgainstTlsServer(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, clientCert := writeClientCertificate(t, dir)
+
+	signatures := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		header := r.Header.Get(SignatureHeader)
+		parts := strings.SplitN(header, ",", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "t=") {
+			signatures <- "malformed " + header
+			return
+		}
+		expected := "v1=" + SignRequest([]byte("signingkey"), strings.TrimPrefix(parts[0], "t="), r.Method, r.URL.RequestURI(), body)
+		if parts[1] != expected {
+			signatures <- "mismatch " + header
+			return
+		}
+		signatures <- "ok"
+	}))
+	clientCas := x509.NewCertPool()
+	clientCas.AddCert(clientCert)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCas,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(cert, key, ca, pins, signingKey string) {
+		apiClientCert, apiClientKey, apiCaFile, apiPins, apiSigningKey = cert, key, ca, pins, signingKey
+	}(apiClientCert, apiClientKey, apiCaFile, apiPins, apiSigningKey)
+	apiClientCert, apiClientKey, apiCaFile, apiSigningKey = certFile, keyFile, caFile, "signingkey"
+
+	cases := []struct {
+		name    string
+		pins    string
+		extra   bool
+		succeed bool
+	}{
+		{"pin match", "AAAA, " + CertificatePin(server.Certificate()), false, true},
+		{"pin mismatch", "AAAA", false, false},
+		{"pin of unverified certificate", CertificatePin(clientCert), true, false},
+	}
+	served := server.TLS.Certificates[0].Certificate
+	for _, c := range cases {
+		apiPins = c.pins
+		server.TLS.Certificates[0].Certificate = served
+		if c.extra {
+			server.TLS.Certificates[0].Certificate = append(served[:len(served):len(served)], clientCert.Raw)
+		}
+		if err := InitClient(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		res, err := GetClient().Post(server.URL+"/ddr/song/scores?ids=abc", "application/json", strings.NewReader(`{"a":1}`))
+		if !c.succeed {
+			if err == nil {
+				res.Body.Close()
+				t.Errorf("%s: request succeeded", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		res.Body.Close()
+		if signature := <-signatures; signature != "ok" {
+			t.Errorf("%s: signature %s", c.name, signature)
+		}
+	}
+}
+
+func TestSignRequestCoversQuery(t *testing.T) {
+	key := []byte("signingkey")
+	a := SignRequest(key, "1", http.MethodGet, "/ddr/song/scores?ids=abc", nil)
+	b := SignRequest(key, "1", http.MethodGet, "/ddr/song/scores?ids=def", nil)
+	if a == b {
+		t.Error("signature does not depend on the query")
+	}
+}
@@ -0,0 +1,338 @@
+package utilities
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"github.com/golang/glog"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+var (
+	// encodingExtensions lists the supported encodings by preference, along
+	// with the extension of their precompressed siblings.
+	encodingExtensions = []struct {
+		encoding  string
+		extension string
+	}{
+		{encodingBrotli, ".br"},
+		{encodingGzip, ".gz"},
+	}
+
+	compressibleExtensions = map[string]bool{
+		".js": true, ".css": true, ".html": true, ".json": true,
+		".svg": true, ".txt": true, ".map": true, ".xml": true,
+	}
+)
+
+// precompressedFile is an encoded representation of a static file, either a
+// sibling file such as app.js.br or generated at startup.
+type precompressedFile struct {
+	name    string
+	content []byte
+}
+
+type precompressedFiles struct {
+	sync.RWMutex
+	files map[string]map[string]precompressedFile
+}
+
+var (
+	precompressed precompressedFiles
+)
+
+// BuildPrecompressed records the precompressed siblings of StaticFiles.
+// With -precompress, compressible files without a .gz sibling are gzipped
+// into memory, so they need not be compressed per request.
+func BuildPrecompressed() error {
+	files := make(map[string]map[string]precompressedFile)
+	generated := 0
+
+	err := fs.WalkDir(StaticFiles, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		for _, e := range encodingExtensions {
+			if strings.HasSuffix(name, e.extension) {
+				return nil
+			}
+		}
+
+		encodings := make(map[string]precompressedFile)
+		for _, e := range encodingExtensions {
+			if _, err := fs.Stat(StaticFiles, name+e.extension); err == nil {
+				encodings[e.encoding] = precompressedFile{name: name + e.extension}
+			}
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if _, ok := encodings[encodingGzip]; !ok && Precompress && compressible(name) && info.Size() >= int64(CompressMinSize) {
+			content, err := gzipStaticFile(name)
+			if err != nil {
+				return err
+			}
+			encodings[encodingGzip] = precompressedFile{name: name, content: content}
+			generated++
+		}
+
+		if len(encodings) > 0 {
+			files["/"+name] = encodings
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	precompressed.Lock()
+	precompressed.files = files
+	precompressed.Unlock()
+	glog.Infof("%d static files precompressed, %d generated", len(files), generated)
+	return nil
+}
+
+func compressible(name string) bool {
+	return compressibleExtensions[strings.ToLower(path.Ext(name))]
+}
+
+func gzipStaticFile(name string) ([]byte, error) {
+	f, err := StaticFiles.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var buffer bytes.Buffer
+	writer, _ := gzip.NewWriterLevel(&buffer, gzip.BestCompression)
+	if _, err = io.Copy(writer, f); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// acceptedEncodings returns the encodings the client accepts with a non-zero
+// quality.
+func acceptedEncodings(r *http.Request) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if len(encoding) == 0 {
+			continue
+		}
+		accepted[encoding] = true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					accepted[encoding] = false
+				}
+			}
+		}
+	}
+	return accepted
+}
+
+// PrecompressedFiles serves the brotli or gzip representation of a static
+// file when the client accepts it and one exists.
+func PrecompressedFiles(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	addVary(rw.Header(), "Accept-Encoding")
+
+	name := path.Clean(r.URL.Path)
+	precompressed.RLock()
+	encodings, ok := precompressed.files[name]
+	precompressed.RUnlock()
+	if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		next(rw, r)
+		return
+	}
+
+	accepted := acceptedEncodings(r)
+	for _, e := range encodingExtensions {
+		file, ok := encodings[e.encoding]
+		if !ok || !accepted[e.encoding] {
+			continue
+		}
+		if servePrecompressed(rw, r, name, e.encoding, file) {
+			return
+		}
+	}
+	next(rw, r)
+}
+
+func servePrecompressed(rw http.ResponseWriter, r *http.Request, name string, encoding string, file precompressedFile) bool {
+	var content io.ReadSeeker
+	modTime := time.Time{}
+	if file.content != nil {
+		content = bytes.NewReader(file.content)
+	} else {
+		f, err := StaticFiles.Open(file.name)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+		seeker, ok := f.(io.ReadSeeker)
+		if !ok {
+			return false
+		}
+		if info, err := f.Stat(); err == nil {
+			modTime = info.ModTime()
+		}
+		content = seeker
+	}
+
+	if contentType := mime.TypeByExtension(path.Ext(name)); len(contentType) > 0 {
+		rw.Header().Set("Content-Type", contentType)
+	}
+	if etag := rw.Header().Get("ETag"); len(etag) > 0 {
+		rw.Header().Set("ETag", strings.TrimSuffix(etag, "\"")+"-"+encoding+"\"")
+	}
+	rw.Header().Set("Content-Encoding", encoding)
+	http.ServeContent(rw, r, name, modTime, content)
+	return true
+}
+
+// gzipResponseWriter buffers a response until it reaches CompressMinSize,
+// then streams the remainder gzipped. Smaller responses are sent as is.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buffer  bytes.Buffer
+	gzip    *gzip.Writer
+	skipped bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.gzip != nil {
+		return w.gzip.Write(b)
+	}
+	if w.skipped {
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buffer.Write(b)
+	if w.buffer.Len() >= CompressMinSize {
+		w.start()
+	}
+	return len(b), nil
+}
+
+// addVary adds value to the Vary header unless it is listed already.
+func addVary(header http.Header, value string) {
+	for _, vary := range header.Values("Vary") {
+		for _, listed := range strings.Split(vary, ",") {
+			if strings.EqualFold(strings.TrimSpace(listed), value) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", value)
+}
+
+// start decides whether the response is compressed and sends the headers
+// along with anything buffered so far.
+func (w *gzipResponseWriter) start() {
+	// e.g. when flushed before anything was written
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	header := w.ResponseWriter.Header()
+	if len(header.Get("Content-Encoding")) > 0 || w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		w.skip()
+		return
+	}
+
+	header.Set("Content-Encoding", encodingGzip)
+	header.Del("Content-Length")
+	if etag := header.Get("ETag"); len(etag) > 0 && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.gzip = gzip.NewWriter(w.ResponseWriter)
+	w.gzip.Write(w.buffer.Bytes())
+	w.buffer.Reset()
+}
+
+func (w *gzipResponseWriter) skip() {
+	w.skipped = true
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	// an empty write would commit an implicit 200
+	if w.buffer.Len() > 0 {
+		w.ResponseWriter.Write(w.buffer.Bytes())
+	}
+	w.buffer.Reset()
+}
+
+func (w *gzipResponseWriter) finish() {
+	switch {
+	case w.gzip != nil:
+		w.gzip.Close()
+	case !w.skipped:
+		w.skip()
+	}
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gzip == nil && !w.skipped {
+		w.start()
+	}
+	if w.gzip != nil {
+		w.gzip.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// CompressResponses gzips responses of at least CompressMinSize bytes for
+// clients accepting it.
+func CompressResponses(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	addVary(rw.Header(), "Accept-Encoding")
+	if !acceptedEncodings(r)[encodingGzip] || r.Method == http.MethodHead {
+		next(rw, r)
+		return
+	}
+
+	writer := &gzipResponseWriter{ResponseWriter: rw}
+	next(writer, r)
+	// not deferred, so a panic leaves the response to Recovery
+	writer.finish()
+}
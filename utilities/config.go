@@ -1,9 +1,27 @@
 package utilities
 
-import "flag"
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
 
 var (
 	StaticDirectory string
+	TemplateDirectory string
+	DevMode bool
+	DevPollInterval time.Duration
+	Precompress bool
+	CompressMinSize int
+	mediaCacheDirectory string
+	imageWidths string
+	contentSecurityPolicy string
+	cspReportOnly bool
+	CspReportPath string
+	referrerPolicy string
+	frameOptions string
+	hstsMaxAge time.Duration
 	IndexPage string
 	NotFoundPage string
 	CssDirectory string
@@ -17,19 +35,71 @@ var (
 	authClientIssuer string
 	authClientAudience string
 	callbackResourcePath string
+	BackChannelLogoutPath string
 
 	fileStoreKey string
 
 	ServeHost string
 	ServePort string
 
-	BstApi string
+	bstApiHosts string
+	upstreamStrategy string
+	upstreamCheckInterval time.Duration
+	StatusInterval time.Duration
+	StatusRetention time.Duration
+	DashboardTimeout time.Duration
+	BatchMaxRequests int
+	BatchConcurrency int
+	canaryApiHosts string
+	canarySubs map[string]bool
+	canaryRole string
+	canaryOptIn bool
+	roleClaim string
+	canaryCookieName string
 	BstApiBase string
+
+	apiClientCert string
+	apiClientKey string
+	apiCaFile string
+	apiPins string
+	apiSigningKey string
+	webhookKey string
+
+	cacheDeclarations string
+	cacheDirectory string
+	cacheSnapshotDirectory string
+	CacheSnapshotInterval time.Duration
+	redisAddress string
+	redisPassword string
+	redisDatabase int
+
+	auditLogPath string
+	auditLogMaxSize int
+	auditLogBackups int
+	crashLogPath string
+	crashLogMaxSize int
+	crashLogBackups int
+
+	adminSubs map[string]bool
 )
 
-// LoadConfig populates general configuration values to be used with the program.
-func LoadConfig() {
-	flag.StringVar(&StaticDirectory, "static", "./dist", "the directory containing all static files.")
+// LoadConfig populates general configuration values to be used with the program,
+// returning an error for values the server cannot run with.
+func LoadConfig() error {
+	flag.StringVar(&StaticDirectory, "static", "", "serve static files from this directory instead of the embedded ones.")
+	flag.StringVar(&TemplateDirectory, "templates", "", "load page templates from this directory instead of the embedded ones.")
+	flag.BoolVar(&DevMode, "dev", false, "development mode: serve plain http, disable caching and reload pages when templates or static files change.")
+	flag.DurationVar(&DevPollInterval, "devpoll", time.Second, "how often files are checked for changes in development mode.")
+	flag.BoolVar(&Precompress, "precompress", true, "gzip compressible static files without a .gz sibling at startup.")
+	flag.StringVar(&mediaCacheDirectory, "mediacache", "./media_cache", "the directory resized and converted image variants are kept in.")
+	flag.StringVar(&imageWidths, "imagewidths", "32,64,128,256,512,1024", "comma separated widths image variants may be requested in.")
+	flag.StringVar(&contentSecurityPolicy, "csp", "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'nonce-{nonce}'; img-src 'self' data:; font-src 'self'; connect-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'; form-action 'self'", "the Content-Security-Policy, {nonce} is replaced with the per-request nonce. empty to disable.")
+	flag.BoolVar(&cspReportOnly, "cspreportonly", false, "only report Content-Security-Policy violations instead of enforcing the policy.")
+	flag.StringVar(&CspReportPath, "cspreport", "/csp-report", "the path receiving Content-Security-Policy violation reports, empty to disable.")
+	flag.StringVar(&referrerPolicy, "referrerpolicy", "strict-origin-when-cross-origin", "the Referrer-Policy header.")
+	flag.StringVar(&frameOptions, "frameoptions", "DENY", "the X-Frame-Options header, empty to disable.")
+	flag.DurationVar(&hstsMaxAge, "hsts", 365*24*time.Hour, "the Strict-Transport-Security max-age, 0 to disable.")
+	flag.IntVar(&CompressMinSize, "compressminsize", 1024, "minimum size in bytes of responses and static files worth compressing.")
 	flag.StringVar(&IndexPage, "index", "/index.html", "the location of the index page, relative to the `static` directory.")
 	flag.StringVar(&NotFoundPage, "404", "/404.html", "the location of the 404 page, relative to the `static` directory.")
 	flag.StringVar(&CssDirectory, "css", "/css", "the directory to serve css files from, relative to the `static` directory.")
@@ -43,14 +113,71 @@ func LoadConfig() {
 	flag.StringVar(&authClientIssuer, "issuer", "", "the issuer for auth server.")
 	flag.StringVar(&authClientAudience, "audience", "", "the audience for auth server.")
 	flag.StringVar(&callbackResourcePath, "callback", "/callback", "the callback for the auth server to use.")
+	flag.StringVar(&BackChannelLogoutPath, "backchannel", "/backchannel-logout", "the path receiving back-channel logout requests from the auth server.")
 
 	flag.StringVar(&fileStoreKey, "filestorekey", "", "the key to use for filestore encryption.")
 
 	flag.StringVar(&ServeHost, "host", "", "the host.")
 	flag.StringVar(&ServePort, "port", "443", "the port.")
 
-	flag.StringVar(&BstApi, "api", "", "bst api host.")
+	flag.StringVar(&bstApiHosts, "api", "", "comma separated bst api hosts, each optionally weighted as host=weight.")
+	flag.StringVar(&upstreamStrategy, "apistrategy", "roundrobin", "how bst api hosts are chosen: roundrobin (weighted) or failover (first healthy host in order).")
+	flag.DurationVar(&StatusInterval, "statusinterval", 30*time.Second, "how often the bst api status is polled, must be positive.")
+	flag.DurationVar(&StatusRetention, "statusretention", 7*24*time.Hour, "how long status history is kept.")
+	flag.DurationVar(&DashboardTimeout, "dashboardtimeout", 5*time.Second, "deadline shared by the upstream calls of the dashboard endpoint.")
+	flag.IntVar(&BatchMaxRequests, "batchmax", 50, "maximum number of sub-requests in one batch request.")
+	flag.IntVar(&BatchConcurrency, "batchconcurrency", 4, "maximum number of sub-requests of one batch request executed concurrently.")
+	flag.StringVar(&canaryApiHosts, "canaryapi", "", "comma separated alternate bst api hosts canary users are routed to.")
+	canary := flag.String("canarysubs", "", "comma separated list of user subs routed to the canary api.")
+	flag.StringVar(&canaryRole, "canaryrole", "", "users holding this role are routed to the canary api.")
+	flag.BoolVar(&canaryOptIn, "canaryoptin", false, "let any logged in user opt into the canary api through the canary cookie, not only canary subs and role holders.")
+	flag.StringVar(&roleClaim, "roleclaim", "https://bst/roles", "the id token claim listing a users roles.")
+	flag.StringVar(&canaryCookieName, "canarycookie", "bst_canary", "the cookie opting users in to or out of the canary api.")
+	flag.DurationVar(&upstreamCheckInterval, "apicheckinterval", 15*time.Second, "how often the status of every bst api host is checked.")
 	flag.StringVar(&BstApiBase, "apibase", "/", "bst api base path.")
+	flag.StringVar(&apiClientCert, "apicert", "", "client certificate presented to the bst api.")
+	flag.StringVar(&apiClientKey, "apikey", "", "private key of the client certificate presented to the bst api.")
+	flag.StringVar(&apiCaFile, "apica", "", "pem file of CAs trusted for the bst api, instead of the system pool.")
+	flag.StringVar(&apiPins, "apipin", "", "comma separated base64 sha256 hashes of pinned bst api public keys.")
+	flag.StringVar(&apiSigningKey, "apisigningkey", "", "key used to sign requests to the bst api.")
+	flag.StringVar(&webhookKey, "webhookkey", "", "key the bst api signs cache invalidation webhooks with.")
+
+	flag.StringVar(&cacheDeclarations, "caches", "users:memory:15m:10000,logout_tokens:memory:24h:100000,webhook_events:memory:15m:100000,ddr_stats:memory:10m:200,ddr_profile:memory:10m:2000,drs_details:memory:10m:2000,drs_tabledata:memory:10m:200,last_known_good:disk:168h:5000", "comma separated cache declarations of the form name:backend:ttl:maxsize. backends are memory, disk and redis.")
+	flag.StringVar(&cacheDirectory, "cachedir", "./cache", "the directory used by disk caches.")
+	flag.StringVar(&cacheSnapshotDirectory, "cachesnapshots", "./cache/snapshots", "the directory in-memory caches are snapshotted to.")
+	flag.DurationVar(&CacheSnapshotInterval, "snapshotinterval", 5*time.Minute, "how often in-memory caches are snapshotted, 0 to only snapshot on shutdown.")
+	flag.StringVar(&redisAddress, "redis", "localhost:6379", "the address of the server used by redis caches.")
+	flag.StringVar(&redisPassword, "redispassword", "", "the password for the redis server.")
+	flag.IntVar(&redisDatabase, "redisdb", 0, "the redis database to use.")
+
+	flag.StringVar(&auditLogPath, "auditlog", "./logs/audit.log", "the file the security audit log is written to.")
+	flag.IntVar(&auditLogMaxSize, "auditmaxsize", 10, "the size in MB at which the audit log is rotated.")
+	flag.IntVar(&auditLogBackups, "auditbackups", 5, "the number of rotated audit logs to keep.")
+
+	flag.StringVar(&crashLogPath, "crashlog", "./logs/crash.log", "the file recovered panics are written to.")
+	flag.IntVar(&crashLogMaxSize, "crashmaxsize", 10, "the size in MB at which the crash log is rotated.")
+	flag.IntVar(&crashLogBackups, "crashbackups", 3, "the number of rotated crash logs to keep.")
+
+	admins := flag.String("admins", "", "comma separated list of user subs with admin access.")
 
 	flag.Parse()
+
+	adminSubs = parseSubList(*admins)
+	canarySubs = parseSubList(*canary)
+
+	if StatusInterval <= 0 {
+		return fmt.Errorf("statusinterval must be positive, got %v", StatusInterval)
+	}
+	return nil
+}
+
+func parseSubList(list string) map[string]bool {
+	subs := make(map[string]bool)
+	for _, sub := range strings.Split(list, ",") {
+		sub = strings.TrimSpace(sub)
+		if len(sub) > 0 {
+			subs[strings.ToLower(sub)] = true
+		}
+	}
+	return subs
 }
\ No newline at end of file
@@ -0,0 +1,147 @@
+package utilities
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// liveReload notifies connected browser tabs when watched files change.
+type liveReload struct {
+	sync.Mutex
+	clients map[chan struct{}]bool
+}
+
+var (
+	reloader = liveReload{clients: make(map[chan struct{}]bool)}
+)
+
+func (l *liveReload) subscribe() chan struct{} {
+	l.Lock()
+	defer l.Unlock()
+	client := make(chan struct{}, 1)
+	l.clients[client] = true
+	return client
+}
+
+func (l *liveReload) unsubscribe(client chan struct{}) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.clients, client)
+}
+
+func (l *liveReload) broadcast() {
+	l.Lock()
+	defer l.Unlock()
+	for client := range l.clients {
+		select {
+		case client <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// StartDevWatcher polls TemplateFiles and StaticFiles for changes.
+// Changed templates are parsed again, changed static files rehashed, and open
+// pages are told to reload.
+// Polling is used so it works without inotify, e.g. on network mounts.
+func StartDevWatcher(interval time.Duration) {
+	templates := directoryFingerprint(TemplateFiles)
+	static := directoryFingerprint(StaticFiles)
+
+	go func() {
+		for range time.Tick(interval) {
+			changed := false
+			if current := directoryFingerprint(TemplateFiles); current != templates {
+				templates = current
+				changed = true
+				if err := LoadTemplates(); err != nil {
+					glog.Errorf("failed to reload templates: %v", err)
+					continue
+				}
+			}
+			if current := directoryFingerprint(StaticFiles); current != static {
+				static = current
+				changed = true
+				if err := BuildAssetManifest(); err != nil {
+					glog.Errorf("failed to rebuild asset manifest: %v", err)
+				}
+				if err := loadPageEntries(); err != nil {
+					glog.Errorf("failed to reload page entries: %v", err)
+				}
+				if err := BuildPrecompressed(); err != nil {
+					glog.Errorf("failed to precompress static files: %v", err)
+				}
+			}
+			if changed {
+				glog.Info("files changed, reloading pages")
+				reloader.broadcast()
+			}
+		}
+	}()
+}
+
+// directoryFingerprint summarises the number, sizes and modification times
+// of every file in files.
+func directoryFingerprint(files fs.FS) string {
+	var count, size int64
+	var latest time.Time
+	fs.WalkDir(files, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		count++
+		size += info.Size()
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return fmt.Sprintf("%d:%d:%d", count, size, latest.UnixNano())
+}
+
+// LiveReloadHandler streams a reload event to the browser whenever the
+// dev watcher sees a change.
+func LiveReloadHandler(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	client := reloader.subscribe()
+	defer reloader.unsubscribe(client)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-client:
+			fmt.Fprint(rw, "event: reload\ndata: {}\n\n")
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(rw, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// NoCacheMiddleware stops browsers caching anything while in dev mode.
+func NoCacheMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	rw.Header().Set("Cache-Control", "no-store")
+	next(rw, r)
+}
@@ -0,0 +1,63 @@
+package utilities
+
+import (
+	"encoding/json"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+var (
+	// jsonPrefixes are the routes answered in json regardless of Accept.
+	jsonPrefixes = []string{"/external/", "/admin/", "/webhook/"}
+)
+
+// RenderError responds with err. Api routes and clients preferring json
+// receive the error itself, browsers the templated error page.
+func RenderError(rw http.ResponseWriter, r *http.Request, err bst_models.Error) {
+	if WantsJson(r) {
+		bytes, _ := json.Marshal(err)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(err.CorrespondingHttpCode)
+		rw.Write(bytes)
+		return
+	}
+
+	page := "error"
+	switch err.CorrespondingHttpCode {
+	case http.StatusNotFound:
+		page = "404"
+	case http.StatusUnauthorized:
+		page = "401"
+	}
+	RenderPage(rw, r, err.CorrespondingHttpCode, page, PageData{Data: err})
+}
+
+// WantsJson reports whether errors for the request should be json rather
+// than html.
+func WantsJson(r *http.Request) bool {
+	for _, prefix := range jsonPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+
+	accept := r.Header.Get("Accept")
+	jsonIndex := strings.Index(accept, "application/json")
+	if jsonIndex < 0 {
+		return false
+	}
+	htmlIndex := strings.Index(accept, "text/html")
+	return htmlIndex < 0 || jsonIndex < htmlIndex
+}
+
+// HandleRouterErrors renders unmatched paths and methods of router with
+// RenderError.
+func HandleRouterErrors(router *mux.Router) *mux.Router {
+	router.NotFoundHandler = http.HandlerFunc(NotFoundMiddleware)
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		RenderError(rw, r, ErrorMethodNotAllowed)
+	})
+	return router
+}
@@ -0,0 +1,45 @@
+package utilities
+
+import (
+	bst_models "github.com/chris-sg/bst_server_models"
+	"net/http"
+)
+
+// web errors 1000-1099
+var (
+	ErrorEagateThrottled = bst_models.Error{
+		Code:                  1000,
+		CorrespondingHttpCode: http.StatusTooManyRequests,
+		Message:               "too many eagate login attempts, slow down",
+	}
+	ErrorEagateLocked = bst_models.Error{
+		Code:                  1001,
+		CorrespondingHttpCode: http.StatusTooManyRequests,
+		Message:               "eagate login temporarily locked",
+	}
+	ErrorDeadline = bst_models.Error{
+		Code:                  1002,
+		CorrespondingHttpCode: http.StatusGatewayTimeout,
+		Message:               "bst api did not respond in time",
+	}
+	ErrorNotFound = bst_models.Error{
+		Code:                  1003,
+		CorrespondingHttpCode: http.StatusNotFound,
+		Message:               "resource not found",
+	}
+	ErrorUnauthorized = bst_models.Error{
+		Code:                  1004,
+		CorrespondingHttpCode: http.StatusUnauthorized,
+		Message:               "login required",
+	}
+	ErrorMethodNotAllowed = bst_models.Error{
+		Code:                  1005,
+		CorrespondingHttpCode: http.StatusMethodNotAllowed,
+		Message:               "method not allowed",
+	}
+	ErrorInternal = bst_models.Error{
+		Code:                  1006,
+		CorrespondingHttpCode: http.StatusInternalServerError,
+		Message:               "internal server error",
+	}
+)
@@ -0,0 +1,51 @@
+package utilities
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CachedResponse is a proxied response body kept for a user.
+type CachedResponse struct {
+	Body   []byte
+	ETag   string
+	Stored time.Time
+}
+
+// NewCachedResponse wraps body with its strong ETag.
+func NewCachedResponse(body []byte) CachedResponse {
+	return CachedResponse{
+		Body:   body,
+		ETag:   ContentETag(body),
+		Stored: time.Now(),
+	}
+}
+
+// ContentETag returns a strong ETag derived from the content hash.
+func ContentETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
+
+// ETagMatches reports whether the If-None-Match header of the request matches
+// etag, using the weak comparison RFC 7232 requires for If-None-Match.
+func ETagMatches(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if len(header) == 0 {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package utilities
+
+import (
+	"crypto/hmac"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invalidation event types sent by the BST API.
+const (
+	InvalidateUserCache = "user_cache"
+	InvalidateDdrStats  = "ddr_stats"
+	InvalidateDrsData   = "drs_data"
+)
+
+const (
+	webhookTolerance      = 5 * time.Minute
+	recentInvalidationMax = 100
+)
+
+var (
+	// invalidationTargets maps event types to the caches holding per-user
+	// data of that kind.
+	invalidationTargets = map[string][]string{
+		InvalidateUserCache: {"users"},
+		InvalidateDdrStats:  {"ddr_stats", "ddr_profile"},
+		InvalidateDrsData:   {"drs_details", "drs_tabledata"},
+	}
+
+	recentInvalidations      = make([]InvalidationRecord, 0, recentInvalidationMax)
+	recentInvalidationsMutex sync.Mutex
+)
+
+// InvalidationEvent is the body of a cache invalidation webhook.
+type InvalidationEvent struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	User string `json:"user"`
+}
+
+// InvalidationRecord is kept for every received webhook, accepted or not.
+type InvalidationRecord struct {
+	Time    time.Time `json:"time"`
+	Id      string    `json:"id"`
+	Type    string    `json:"type"`
+	User    string    `json:"user"`
+	Outcome string    `json:"outcome"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// VerifyWebhookSignature checks a signature header of the form
+// t=<unix time>,v1=<hex hmac> produced with SignRequest and the webhook key.
+func VerifyWebhookSignature(header string, method string, requestUri string, body []byte) error {
+	if len(webhookKey) == 0 {
+		return errors.New("no webhook key configured")
+	}
+
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signature = kv[1]
+		}
+	}
+	if len(timestamp) == 0 || len(signature) == 0 {
+		return errors.New("malformed signature header")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature timestamp")
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > webhookTolerance || age < -webhookTolerance {
+		return errors.New("signature timestamp outside of tolerance")
+	}
+
+	expected := SignRequest([]byte(webhookKey), timestamp, method, requestUri, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// ApplyInvalidation evicts the cached data named by event. Event ids are
+// remembered for longer than the signature tolerance so replayed deliveries
+// are rejected.
+func ApplyInvalidation(event InvalidationEvent) error {
+	targets, ok := invalidationTargets[event.Type]
+	if !ok {
+		return errors.New("unknown invalidation type " + event.Type)
+	}
+	if len(event.Id) == 0 || len(event.User) == 0 {
+		return errors.New("invalidation requires id and user")
+	}
+	if GetCacheValue("webhook_events", event.Id) != nil {
+		return errors.New("event " + event.Id + " has already been processed")
+	}
+	if !SetCacheValue("webhook_events", event.Id, true) {
+		return errors.New("replay protection requires a webhook_events cache")
+	}
+
+	for _, cacheName := range targets {
+		ClearCacheValue(cacheName, event.User)
+		ClearUserCacheValue(cacheName, event.User)
+	}
+	return nil
+}
+
+// RecordInvalidation adds an entry to the list of recent invalidations.
+func RecordInvalidation(record InvalidationRecord) {
+	recentInvalidationsMutex.Lock()
+	defer recentInvalidationsMutex.Unlock()
+
+	if len(recentInvalidations) == recentInvalidationMax {
+		recentInvalidations = recentInvalidations[1:]
+	}
+	recentInvalidations = append(recentInvalidations, record)
+}
+
+// RecentInvalidations returns the most recent invalidations, newest first.
+func RecentInvalidations() []InvalidationRecord {
+	recentInvalidationsMutex.Lock()
+	defer recentInvalidationsMutex.Unlock()
+
+	records := make([]InvalidationRecord, len(recentInvalidations))
+	for i, record := range recentInvalidations {
+		records[len(records)-1-i] = record
+	}
+	return records
+}
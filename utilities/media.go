@@ -0,0 +1,352 @@
+package utilities
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/glog"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxImagePixels = 40 * 1000 * 1000
+	jpegQuality    = 85
+	// maxVariantJobs bounds how many source images are decoded at once.
+	maxVariantJobs = 2
+)
+
+var (
+	// mediaTypes extends the system mime table with formats used by media.
+	mediaTypes = map[string]string{
+		".png":   "image/png",
+		".jpg":   "image/jpeg",
+		".jpeg":  "image/jpeg",
+		".gif":   "image/gif",
+		".webp":  "image/webp",
+		".avif":  "image/avif",
+		".svg":   "image/svg+xml",
+		".ico":   "image/x-icon",
+		".mp3":   "audio/mpeg",
+		".ogg":   "audio/ogg",
+		".opus":  "audio/ogg",
+		".m4a":   "audio/mp4",
+		".wav":   "audio/wav",
+		".flac":  "audio/flac",
+		".mp4":   "video/mp4",
+		".m4v":   "video/mp4",
+		".webm":  "video/webm",
+		".woff":  "font/woff",
+		".woff2": "font/woff2",
+		".ttf":   "font/ttf",
+		".json":  "application/json",
+	}
+
+	imageFormats = map[string]string{
+		"png":  "image/png",
+		"jpeg": "image/jpeg",
+		"gif":  "image/gif",
+	}
+
+	allowedImageWidths map[int]bool
+	variantJobs        = make(chan struct{}, maxVariantJobs)
+	variantsInFlight   = struct {
+		sync.Mutex
+		keys map[string]chan struct{}
+	}{keys: make(map[string]chan struct{})}
+)
+
+// InitMedia parses the allowed image variant widths, creates the variant
+// cache directory and removes variants of images that are no longer served.
+// It must run after BuildAssetManifest.
+func InitMedia() error {
+	allowedImageWidths = make(map[int]bool)
+	for _, width := range strings.Split(imageWidths, ",") {
+		width = strings.TrimSpace(width)
+		if len(width) == 0 {
+			continue
+		}
+		w, err := strconv.Atoi(width)
+		if err != nil || w <= 0 {
+			return fmt.Errorf("invalid image width %q", width)
+		}
+		allowedImageWidths[w] = true
+	}
+	if err := os.MkdirAll(mediaCacheDirectory, 0755); err != nil {
+		return err
+	}
+	pruneImageVariants()
+	return nil
+}
+
+// pruneImageVariants removes every file of the variant cache which is not a
+// variant of a current image. Variant names contain the image ETag, so each
+// deploy that changes an image leaves its old variants behind.
+func pruneImageVariants() {
+	current := make(map[string]bool)
+	assets.RLock()
+	for _, a := range assets.byPath {
+		if !strings.HasPrefix(MediaType(a.path), "image/") {
+			continue
+		}
+		for _, format := range []string{"", "png", "jpeg", "gif"} {
+			current[variantName(a, 0, format)] = true
+			for width := range allowedImageWidths {
+				current[variantName(a, width, format)] = true
+			}
+		}
+	}
+	assets.RUnlock()
+
+	entries, err := ioutil.ReadDir(mediaCacheDirectory)
+	if err != nil {
+		glog.Warningf("failed to list %s: %v", mediaCacheDirectory, err)
+		return
+	}
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || current[strings.TrimSuffix(entry.Name(), ".type")] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(mediaCacheDirectory, entry.Name())); err != nil {
+			glog.Warningf("failed to remove stale image variant %s: %v", entry.Name(), err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		glog.Infof("removed %d stale image variant files", removed)
+	}
+}
+
+// variantName returns the file name below -mediacache of a variant.
+func variantName(a asset, width int, format string) string {
+	sum := sha256.Sum256([]byte(variantKey(a, width, format)))
+	return hex.EncodeToString(sum[:16])
+}
+
+func variantKey(a asset, width int, format string) string {
+	return fmt.Sprintf("%s:%s:%d:%s", a.path, a.etag, width, format)
+}
+
+// MediaType returns the content type of the media file at name.
+func MediaType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if mediaType, ok := mediaTypes[ext]; ok {
+		return mediaType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// ImageVariants serves a resized or converted copy of an image when the w or
+// format query parameters are given, e.g. /media/jacket.png?w=128. Variants
+// are generated once and kept below -mediacache.
+func ImageVariants(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	query := r.URL.Query()
+	if len(query.Get("w")) == 0 && len(query.Get("format")) == 0 {
+		next(rw, r)
+		return
+	}
+
+	a, _, ok := lookupAsset(path.Clean(r.URL.Path))
+	if !ok {
+		next(rw, r)
+		return
+	}
+
+	width := 0
+	if w := query.Get("w"); len(w) > 0 {
+		var err error
+		if width, err = strconv.Atoi(w); err != nil || !allowedImageWidths[width] {
+			variantError(rw, "w must be one of "+imageWidths, http.StatusBadRequest)
+			return
+		}
+	}
+	format := strings.ToLower(query.Get("format"))
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if _, ok := imageFormats[format]; len(format) > 0 && !ok {
+		variantError(rw, "format must be one of png, jpeg, gif", http.StatusBadRequest)
+		return
+	}
+
+	variant, contentType, err := imageVariant(a, width, format)
+	if err != nil {
+		glog.Warningf("failed to create variant of %s: %v", a.path, err)
+		variantError(rw, "image variant could not be created", http.StatusUnprocessableEntity)
+		return
+	}
+	defer variant.Close()
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("ETag", fmt.Sprintf("\"%s-%d%s\"", strings.Trim(a.etag, "\""), width, format))
+	http.ServeContent(rw, r, "", time.Time{}, variant)
+}
+
+// variantError responds with an uncacheable error.
+func variantError(rw http.ResponseWriter, message string, status int) {
+	rw.Header().Del("ETag")
+	rw.Header().Set("Cache-Control", "no-store")
+	http.Error(rw, message, status)
+}
+
+// imageVariant opens the cached variant of the image, creating it first when
+// needed. Concurrent requests for the same variant wait for a single
+// creation, and at most maxVariantJobs variants are created at once.
+func imageVariant(a asset, width int, format string) (*os.File, string, error) {
+	key := variantKey(a, width, format)
+	name := filepath.Join(mediaCacheDirectory, variantName(a, width, format))
+
+	for {
+		if f, err := os.Open(name); err == nil {
+			contentType, err := ioutil.ReadFile(name + ".type")
+			if err != nil {
+				f.Close()
+				return nil, "", err
+			}
+			return f, string(contentType), nil
+		}
+
+		variantsInFlight.Lock()
+		wait, busy := variantsInFlight.keys[key]
+		if !busy {
+			variantsInFlight.keys[key] = make(chan struct{})
+		}
+		variantsInFlight.Unlock()
+		if busy {
+			<-wait
+			continue
+		}
+
+		variantJobs <- struct{}{}
+		err := createImageVariant(a, width, format, name)
+		<-variantJobs
+		variantsInFlight.Lock()
+		close(variantsInFlight.keys[key])
+		delete(variantsInFlight.keys, key)
+		variantsInFlight.Unlock()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+func createImageVariant(a asset, width int, format string, name string) error {
+	f, err := StaticFiles.Open(strings.TrimPrefix(a.path, "/"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	source, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	config, sourceFormat, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		return err
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return fmt.Errorf("image of %dx%d is too large", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(source))
+	if err != nil {
+		return err
+	}
+
+	if width > 0 && width < config.Width {
+		height := (config.Height*width + config.Width/2) / config.Width
+		if height < 1 {
+			height = 1
+		}
+		img = resizeImage(img, width, height)
+	}
+	if len(format) == 0 {
+		format = sourceFormat
+	}
+
+	var encoded bytes.Buffer
+	switch format {
+	case "png":
+		err = png.Encode(&encoded, img)
+	case "jpeg":
+		err = jpeg.Encode(&encoded, img, &jpeg.Options{Quality: jpegQuality})
+	case "gif":
+		err = gif.Encode(&encoded, img, nil)
+	default:
+		err = fmt.Errorf("unsupported image format %s", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(name+".type", []byte(imageFormats[format]), 0644); err != nil {
+		return err
+	}
+	temp := name + ".tmp"
+	if err = ioutil.WriteFile(temp, encoded.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, name)
+}
+
+// resizeImage scales src down to width x height, averaging the source pixels
+// covered by each destination pixel. The source is converted to RGBA one band
+// of rows at a time rather than copied whole.
+func resizeImage(src image.Image, width int, height int) image.Image {
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	band := image.NewRGBA(image.Rect(0, 0, srcWidth, (srcHeight+height-1)/height+1))
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := (y + 1) * srcHeight / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		draw.Draw(band, image.Rect(0, 0, srcWidth, y1-y0), src, image.Pt(bounds.Min.X, bounds.Min.Y+y0), draw.Src)
+
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := (x + 1) * srcWidth / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, alpha, count int
+			for sy := 0; sy < y1-y0; sy++ {
+				offset := band.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(band.Pix[offset])
+					g += int(band.Pix[offset+1])
+					b += int(band.Pix[offset+2])
+					alpha += int(band.Pix[offset+3])
+					offset += 4
+					count++
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / count)
+			dst.Pix[offset+1] = uint8(g / count)
+			dst.Pix[offset+2] = uint8(b / count)
+			dst.Pix[offset+3] = uint8(alpha / count)
+		}
+	}
+	return dst
+}
@@ -2,16 +2,14 @@ package utilities
 
 import (
 	"github.com/urfave/negroni"
-	"io/ioutil"
 	"net/http"
-	"path"
-	"strings"
 	"time"
 )
 
 var (
 	commonMiddleware *negroni.Negroni
 	protectionMiddleware *negroni.Negroni
+	adminMiddleware *negroni.Negroni
 	cachingMiddleware *negroni.Negroni
 
 	logger *negroni.Logger
@@ -22,15 +20,26 @@ func PrepareMiddleware() {
 	// MIDDLEWARE DEFINITIONS
 	commonMiddleware = negroni.New(
 		negroni.HandlerFunc(logger.ServeHTTP),
-		negroni.HandlerFunc(PathSanitizer),
+		negroni.HandlerFunc(RequestIdMiddleware),
+		negroni.HandlerFunc(Recovery),
+		negroni.HandlerFunc(SecurityHeaders),
 		negroni.HandlerFunc(RefreshJwt),
-		negroni.HandlerFunc(LogoutIfExpired))
+		negroni.HandlerFunc(LogoutIfExpired),
+		negroni.HandlerFunc(CanaryRouting))
+	if DevMode {
+		commonMiddleware.Use(negroni.HandlerFunc(NoCacheMiddleware))
+	}
 
 	protectionMiddleware = negroni.New(
 		negroni.HandlerFunc(ProtectedResourceMiddleware))
 
+	adminMiddleware = negroni.New(
+		negroni.HandlerFunc(ProtectedResourceMiddleware),
+		negroni.HandlerFunc(AdminResourceMiddleware))
+
 	cachingMiddleware = negroni.New(
-		negroni.HandlerFunc(FileCacher))
+		negroni.HandlerFunc(FileCacher),
+		negroni.HandlerFunc(PrecompressedFiles))
 }
 
 func GetCommonMiddleware() *negroni.Negroni {
@@ -41,31 +50,15 @@ func GetProtectionMiddleware() *negroni.Negroni {
 	return protectionMiddleware
 }
 
+func GetAdminMiddleware() *negroni.Negroni {
+	return adminMiddleware
+}
+
 func GetCachingMiddleware() *negroni.Negroni {
 	return cachingMiddleware
 }
 
 
-func FileCacher(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	rw.Header().Set("Cache-Control", "max-age=3600")
-	upath := r.URL.Path
-	path.Clean(upath)
-	root := http.Dir(StaticDirectory)
-	fs, _ := root.Open(upath)
-
-	var modTime time.Time
-	fi, err := fs.Stat()
-	if err != nil {
-		modTime = fi.ModTime()
-	} else {
-		modTime = time.Now()
-	}
-	etag := "\"" + upath + modTime.String() + "\""
-	rw.Header().Set("Etag", etag)
-
-	next(rw, r)
-}
-
 func ProtectedResourceMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	session, err := Store.Get(r, "auth-session")
 	if err != nil {
@@ -73,14 +66,8 @@ func ProtectedResourceMiddleware(rw http.ResponseWriter, r *http.Request, next h
 		return
 	}
 
-	if session.Values["profile"] == nil {
-		UnauthorizedMiddleware(rw, r)
-		return
-	}
-
-	profile := session.Values["profile"].(map[string]interface{})
-	expTime := time.Unix(int64(profile["exp"].(float64)), 0)
-	if expTime.Unix() < time.Now().Unix() {
+	expTime, _, ok := profileTimes(session)
+	if !ok || expTime.Unix() < time.Now().Unix() {
 		UnauthorizedMiddleware(rw, r)
 		return
 	}
@@ -88,10 +75,9 @@ func ProtectedResourceMiddleware(rw http.ResponseWriter, r *http.Request, next h
 	next(rw, r)
 }
 
-func PathSanitizer(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	if strings.Contains(r.URL.String(), "..") ||
-		strings.Contains(r.URL.String(), "./") {
-		NotFoundMiddleware(rw, r)
+func AdminResourceMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !IsAdmin(r) {
+		UnauthorizedMiddleware(rw, r)
 		return
 	}
 
@@ -107,15 +93,11 @@ func RedirectHomeMiddleware(rw http.ResponseWriter, r *http.Request, next http.H
 }
 
 func NotFoundMiddleware(rw http.ResponseWriter, r *http.Request) {
-	fileBytes, _ := ioutil.ReadFile("./dist/general/404.html")
-	rw.WriteHeader(404)
-	rw.Write(fileBytes)
+	RenderError(rw, r, ErrorNotFound)
 	return
 }
 
 func UnauthorizedMiddleware(rw http.ResponseWriter, r *http.Request) {
-	fileBytes, _ := ioutil.ReadFile("./dist/general/401.html")
-	rw.WriteHeader(404)
-	rw.Write(fileBytes)
+	RenderError(rw, r, ErrorUnauthorized)
 	return
 }
\ No newline at end of file
@@ -0,0 +1,93 @@
+package utilities
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// maxPathDecodes bounds how often a segment is unescaped when looking for
+// traversal hidden behind repeated encoding, e.g. %252e%252e.
+const maxPathDecodes = 3
+
+// NormalizePaths validates the path of every request before it is routed.
+// Paths hiding traversal, separators or control characters behind percent
+// encoding are answered with not found. Paths that are valid but not in
+// canonical form, i.e. containing empty, . or .. segments or a trailing
+// slash, are redirected to their canonical form. The query is left alone.
+func NormalizePaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		escaped := r.URL.EscapedPath()
+		normalized, ok := NormalizePath(escaped)
+		if !ok {
+			NotFoundMiddleware(rw, r)
+			return
+		}
+		if normalized == escaped {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		target := normalized
+		if len(r.URL.RawQuery) > 0 {
+			target += "?" + r.URL.RawQuery
+		}
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			// keeps the method and body
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(rw, r, target, status)
+	})
+}
+
+// NormalizePath returns the canonical form of an escaped request path, or
+// false if the path is malformed or tries to escape the root once decoded.
+// Literal . and .. segments are resolved; encoded ones are rejected, as are
+// encoded slashes and backslashes, null bytes and other control characters.
+func NormalizePath(escaped string) (normalized string, ok bool) {
+	if !strings.HasPrefix(escaped, "/") {
+		return "", false
+	}
+
+	for _, segment := range strings.Split(escaped, "/") {
+		if segment == "." || segment == ".." {
+			continue
+		}
+		if !validPathSegment(segment) {
+			return "", false
+		}
+	}
+
+	// separators are never encoded at this point, so cleaning the escaped
+	// path keeps the encoding of the segments intact
+	return path.Clean(escaped), true
+}
+
+func validPathSegment(segment string) bool {
+	decoded, err := url.PathUnescape(segment)
+	if err != nil {
+		return false
+	}
+	for i := 0; ; i++ {
+		if decoded == "." || decoded == ".." ||
+			strings.ContainsAny(decoded, "/\\") ||
+			strings.IndexFunc(decoded, isControl) >= 0 {
+			return false
+		}
+		if i == maxPathDecodes || !strings.Contains(decoded, "%") {
+			return true
+		}
+		next, err := url.PathUnescape(decoded)
+		if err != nil || next == decoded {
+			// a literal percent sign, e.g. 100%25 decoding to 100%
+			return true
+		}
+		decoded = next
+	}
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
@@ -0,0 +1,143 @@
+package utilities
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNormalizePath(t *testing.T) {
+	cases := []struct {
+		escaped    string
+		normalized string
+		ok         bool
+	}{
+		{"/", "/", true},
+		{"/ddr", "/ddr", true},
+		{"/ddr/", "/ddr", true},
+		{"//ddr//stats", "/ddr/stats", true},
+		{"/ddr/./stats", "/ddr/stats", true},
+		{"/a/../ddr", "/ddr", true},
+		{"/../../etc/passwd", "/etc/passwd", true},
+		{"//evil.com", "/evil.com", true},
+		{"/100%25", "/100%25", true},
+		{"/song%20title", "/song%20title", true},
+		{"/%c3%a9", "/%c3%a9", true},
+		{"/a..b", "/a..b", true},
+		{"/media/x.png", "/media/x.png", true},
+		{"/%2e%2e/etc", "", false},
+		{"/%2E%2e/etc", "", false},
+		{"/.%2e/etc", "", false},
+		{"/%2e/etc", "", false},
+		{"/%252e%252e/etc", "", false},
+		{"/%25252e%25252e/etc", "", false},
+		{"/a%2fb", "", false},
+		{"/a%2Fb", "", false},
+		{"/a%5cb", "", false},
+		{"/a\\b", "", false},
+		{"/a%00b", "", false},
+		{"/a%2500b", "", false},
+		{"/a%0ab", "", false},
+		{"/a%7fb", "", false},
+		{"/a%zzb", "", false},
+		{"*", "", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		normalized, ok := NormalizePath(c.escaped)
+		if normalized != c.normalized || ok != c.ok {
+			t.Errorf("NormalizePath(%q) = %q, %v, want %q, %v", c.escaped, normalized, ok, c.normalized, c.ok)
+		}
+	}
+}
+
+func TestValidPathSegment(t *testing.T) {
+	cases := []struct {
+		segment string
+		valid   bool
+	}{
+		{"ddr", true},
+		{"100%25", true},
+		{"%2525", true},
+		{"...", true},
+		{"%2e", false},
+		{"%2e%2e", false},
+		{"%252e%252e", false},
+		{"%2f", false},
+		{"%255c", false},
+		{"%00", false},
+		{"%09", false},
+		{"%", false},
+	}
+	for _, c := range cases {
+		if valid := validPathSegment(c.segment); valid != c.valid {
+			t.Errorf("validPathSegment(%q) = %v, want %v", c.segment, valid, c.valid)
+		}
+	}
+}
+
+func TestNormalizePathsHandler(t *testing.T) {
+	StaticFiles = fstest.MapFS{
+		"media/x.png":     {Data: []byte("png")},
+		"media/dir/y.png": {Data: []byte("png")},
+	}
+	handler := NormalizePaths(StaticFileServer())
+
+	cases := []struct {
+		method   string
+		target   string
+		status   int
+		location string
+	}{
+		{http.MethodGet, "/media/x.png", http.StatusOK, ""},
+		{http.MethodGet, "/media/x.png?q=../a./b", http.StatusOK, ""},
+		{http.MethodGet, "/media//x.png?q=..", http.StatusMovedPermanently, "/media/x.png?q=.."},
+		{http.MethodPost, "/media/x.png/", http.StatusPermanentRedirect, "/media/x.png"},
+		{http.MethodGet, "/media/dir/", http.StatusMovedPermanently, "/media/dir"},
+		{http.MethodGet, "/media/dir", http.StatusNotFound, ""},
+		{http.MethodGet, "//evil.com", http.StatusMovedPermanently, "/evil.com"},
+		{http.MethodGet, "/media/%2e%2e/x.png", http.StatusNotFound, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.target, nil)
+		r.Header.Set("Accept", "application/json")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		if rw.Code != c.status || rw.Header().Get("Location") != c.location {
+			t.Errorf("%s %s = %d %q, want %d %q", c.method, c.target, rw.Code, rw.Header().Get("Location"), c.status, c.location)
+		}
+	}
+}
+
+// TestNormalizePathRandom feeds random paths built from characters that
+// matter to traversal and checks every accepted path is canonical.
+func TestNormalizePathRandom(t *testing.T) {
+	pieces := []string{"/", "//", ".", "..", "%2e", "%2E", "%25", "%2f", "%5c", "\\", "%00", "%0a", "a", "b", "%", "%32", "%65", "~"}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		var b strings.Builder
+		for n := random.Intn(12); n >= 0; n-- {
+			b.WriteString(pieces[random.Intn(len(pieces))])
+		}
+		escaped := b.String()
+
+		normalized, ok := NormalizePath(escaped)
+		if !ok {
+			continue
+		}
+		if !strings.HasPrefix(normalized, "/") || strings.HasPrefix(normalized, "//") {
+			t.Fatalf("NormalizePath(%q) = %q, want a single leading slash", escaped, normalized)
+		}
+		for _, segment := range strings.Split(normalized, "/") {
+			if segment == "." || segment == ".." {
+				t.Fatalf("NormalizePath(%q) = %q, contains a dot segment", escaped, normalized)
+			}
+		}
+		if again, _ := NormalizePath(normalized); again != normalized {
+			t.Fatalf("NormalizePath(%q) = %q, not stable: %q", escaped, normalized, again)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package utilities
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/urfave/negroni"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	requestIdHeader = "X-Request-Id"
+	maxCrashLine    = 1024 * 1024
+)
+
+type requestIdKey struct{}
+
+// Crash is a recovered panic, as written to the crash log.
+type Crash struct {
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"request_id"`
+	Sub       string    `json:"sub,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+}
+
+var (
+	crashLogger      *auditLog
+	requestIdPattern = regexp.MustCompile(`^[0-9A-Za-z._-]{1,64}$`)
+)
+
+// RequestIdMiddleware tags every request with an id, taken from a well formed
+// X-Request-Id header or generated, and echoes it in the response.
+func RequestIdMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	id := r.Header.Get(requestIdHeader)
+	if !requestIdPattern.MatchString(id) {
+		random := make([]byte, 8)
+		rand.Read(random)
+		id = hex.EncodeToString(random)
+	}
+	rw.Header().Set(requestIdHeader, id)
+	next(rw, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+}
+
+// RequestId returns the id of the request.
+func RequestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// Recovery turns a panic in a later handler into a 500 response and records
+// it, with its stack trace, in the crash log.
+func Recovery(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		if recovered == http.ErrAbortHandler {
+			panic(recovered)
+		}
+
+		crash := Crash{
+			Time:      time.Now().UTC(),
+			RequestId: RequestId(r),
+			Sub:       subForCrash(r),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Panic:     fmt.Sprint(recovered),
+			Stack:     string(debug.Stack()),
+		}
+		// keeps every line readable by RecentCrashes
+		if len(crash.Stack) > maxCrashLine/2 {
+			crash.Stack = crash.Stack[:maxCrashLine/2]
+		}
+		if len(crash.Panic) > maxCrashLine/4 {
+			crash.Panic = crash.Panic[:maxCrashLine/4]
+		}
+		glog.Errorf("panic serving %s %s (request %s, user %s): %s\n%s", crash.Method, crash.Path, crash.RequestId, crash.Sub, crash.Panic, crash.Stack)
+		if err := writeCrash(crash); err != nil {
+			glog.Errorf("failed to write crash log: %v", err)
+		}
+
+		if written, ok := rw.(negroni.ResponseWriter); ok && written.Written() {
+			return
+		}
+		RenderError(rw, r, ErrorInternal)
+	}()
+
+	next(rw, r)
+}
+
+// subForCrash looks up the user of the request, which may itself panic when
+// the session is what caused the crash.
+func subForCrash(r *http.Request) (sub string) {
+	defer func() {
+		if recover() != nil {
+			sub = ""
+		}
+	}()
+	return SubForRequest(r)
+}
+
+// InitCrashLog opens the crash log configured by the `crashlog` flags. Like
+// the audit log it is rotated by size, so a request panicking over and over
+// cannot fill the disk.
+func InitCrashLog() error {
+	if err := os.MkdirAll(filepath.Dir(crashLogPath), 0700); err != nil {
+		return err
+	}
+
+	crashLogger = &auditLog{
+		path:    crashLogPath,
+		maxSize: int64(crashLogMaxSize) * 1024 * 1024,
+		backups: crashLogBackups,
+	}
+	return crashLogger.open()
+}
+
+func writeCrash(crash Crash) error {
+	if crashLogger == nil {
+		return errors.New("crash log not initialised")
+	}
+	line, err := json.Marshal(crash)
+	if err != nil {
+		return err
+	}
+	return crashLogger.writeLine(line)
+}
+
+// RecentCrashes returns up to limit of the latest crashes, newest first.
+func RecentCrashes(limit int) (crashes []Crash, err error) {
+	crashes = make([]Crash, 0)
+	if crashLogger == nil {
+		return
+	}
+
+	paths := crashLogger.paths()
+	for i := len(paths) - 1; i >= 0 && len(crashes) < limit; i-- {
+		older, e := readCrashes(paths[i])
+		if e != nil {
+			err = e
+			return
+		}
+		for j := len(older) - 1; j >= 0 && len(crashes) < limit; j-- {
+			crashes = append(crashes, older[j])
+		}
+	}
+	return
+}
+
+// readCrashes returns the crashes in the named file, oldest first.
+func readCrashes(path string) (crashes []Crash, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxCrashLine)
+	scanner.Split(skipLongLines(maxCrashLine))
+	for scanner.Scan() {
+		crash := Crash{}
+		if json.Unmarshal(scanner.Bytes(), &crash) != nil {
+			continue
+		}
+		crashes = append(crashes, crash)
+	}
+	err = scanner.Err()
+	return
+}
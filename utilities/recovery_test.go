@@ -0,0 +1,48 @@
+package utilities
+
+import (
+	"encoding/json"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"github.com/urfave/negroni"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoveryBehindCompression(t *testing.T) {
+	defer func(size int) { CompressMinSize = size }(CompressMinSize)
+	CompressMinSize = 1024
+
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"panic before writing", func(rw http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}},
+		{"panic after buffered write", func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte("partial"))
+			panic("boom")
+		}},
+	}
+	for _, c := range cases {
+		n := negroni.New(
+			negroni.HandlerFunc(Recovery),
+			negroni.HandlerFunc(CompressResponses),
+			negroni.Wrap(c.handler))
+
+		r := httptest.NewRequest(http.MethodGet, "/external/ddr/profile", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rw := httptest.NewRecorder()
+		n.ServeHTTP(rw, r)
+
+		if rw.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status %d, want 500", c.name, rw.Code)
+			continue
+		}
+		var err bst_models.Error
+		if e := json.Unmarshal(rw.Body.Bytes(), &err); e != nil || !err.Equals(ErrorInternal) {
+			t.Errorf("%s: body %q", c.name, rw.Body.String())
+		}
+	}
+}
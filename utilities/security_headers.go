@@ -0,0 +1,196 @@
+package utilities
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nonceLength         = 16
+	maxCspReportSize    = 16 * 1024
+	cspNoncePlaceholder = "{nonce}"
+	// bound the violations kept between flushes, reports are unauthenticated
+	maxCspViolationKeys  = 1000
+	maxCspViolationField = 256
+)
+
+type cspNonceKey struct{}
+
+// cspReport is a single violation, as sent by the report-uri and the
+// Reporting API mechanisms.
+type cspReport struct {
+	DocumentUri        string `json:"document-uri"`
+	BlockedUri         string `json:"blocked-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+}
+
+// reportingApiReport wraps a violation sent through the Reporting API.
+type reportingApiReport struct {
+	Type string `json:"type"`
+	Body struct {
+		DocumentUrl        string `json:"documentURL"`
+		BlockedUrl         string `json:"blockedURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+	} `json:"body"`
+}
+
+// cspReports counts violations by directive, blocked origin and page, so a
+// single misbehaving page does not flood the log.
+type cspReports struct {
+	sync.Mutex
+	counts  map[string]int
+	dropped int
+}
+
+var (
+	violations = cspReports{counts: make(map[string]int)}
+)
+
+// SecurityHeaders sets the security headers of every response. The
+// Content-Security-Policy carries a fresh nonce per request, which templates
+// use to allow their inline scripts.
+func SecurityHeaders(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	nonce := newNonce()
+	header := rw.Header()
+
+	if len(contentSecurityPolicy) > 0 {
+		policy := strings.Replace(contentSecurityPolicy, cspNoncePlaceholder, nonce, -1)
+		if len(CspReportPath) > 0 {
+			policy += "; report-uri " + CspReportPath
+		}
+		if cspReportOnly {
+			header.Set("Content-Security-Policy-Report-Only", policy)
+		} else {
+			header.Set("Content-Security-Policy", policy)
+		}
+	}
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Referrer-Policy", referrerPolicy)
+	if len(frameOptions) > 0 {
+		header.Set("X-Frame-Options", frameOptions)
+	}
+	if hstsMaxAge > 0 && !DevMode {
+		header.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(hstsMaxAge.Seconds()))+"; includeSubDomains")
+	}
+
+	next(rw, r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce)))
+}
+
+func newNonce() string {
+	nonce := make([]byte, nonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		glog.Errorf("failed to generate csp nonce: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(nonce)
+}
+
+// CspNonce returns the Content-Security-Policy nonce of the request.
+func CspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+// CspReportHandler records Content-Security-Policy violation reports sent
+// by browsers.
+func CspReportHandler(rw http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, maxCspReportSize))
+	if err != nil {
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/reports+json") {
+		reports := []reportingApiReport{}
+		if json.Unmarshal(body, &reports) == nil {
+			for _, report := range reports {
+				if report.Type == "csp-violation" {
+					violations.add(report.Body.EffectiveDirective, report.Body.BlockedUrl, report.Body.DocumentUrl)
+				}
+			}
+		}
+	} else {
+		report := struct {
+			Report cspReport `json:"csp-report"`
+		}{}
+		if json.Unmarshal(body, &report) == nil {
+			directive := report.Report.EffectiveDirective
+			if len(directive) == 0 {
+				directive = report.Report.ViolatedDirective
+			}
+			violations.add(directive, report.Report.BlockedUri, report.Report.DocumentUri)
+		}
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (c *cspReports) add(directive string, blocked string, document string) {
+	if len(directive) == 0 {
+		return
+	}
+	// only the origin of the blocked resource and the path of the page, so
+	// reports differing in query strings are counted together
+	if u, err := url.Parse(blocked); err == nil && len(u.Host) > 0 {
+		blocked = u.Scheme + "://" + u.Host
+	}
+	if u, err := url.Parse(document); err == nil {
+		document = u.Path
+	}
+	key := truncate(directive, maxCspViolationField) + " blocked " + truncate(blocked, maxCspViolationField) +
+		" on " + truncate(document, maxCspViolationField)
+
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.counts[key]; !ok && len(c.counts) >= maxCspViolationKeys {
+		c.dropped++
+		return
+	}
+	c.counts[key]++
+}
+
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	return s[:length] + "..."
+}
+
+func (c *cspReports) flush() {
+	c.Lock()
+	counts, dropped := c.counts, c.dropped
+	c.counts = make(map[string]int)
+	c.dropped = 0
+	c.Unlock()
+
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		glog.Warningf("csp violation: %s (%d reports)", key, counts[key])
+	}
+	if dropped > 0 {
+		glog.Warningf("csp violation: %d reports of further violations dropped", dropped)
+	}
+}
+
+// StartCspReportLogger logs the violations received since the last interval.
+func StartCspReportLogger(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			violations.flush()
+		}
+	}()
+}
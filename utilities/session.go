@@ -0,0 +1,68 @@
+package utilities
+
+import (
+	"github.com/gorilla/securecookie"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RevokeSessions removes every stored auth session belonging to the given
+// subject and/or identity provider session id. The number of removed
+// sessions is returned.
+func RevokeSessions(sub string, sid string) (removed int, err error) {
+	files, err := ioutil.ReadDir(sessionStorePath)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), "session_") {
+			continue
+		}
+
+		filename := filepath.Join(sessionStorePath, file.Name())
+		data, e := ioutil.ReadFile(filename)
+		if e != nil {
+			continue
+		}
+
+		values := make(map[interface{}]interface{})
+		if e := securecookie.DecodeMulti("auth-session", string(data), &values, Store.Codecs...); e != nil {
+			continue
+		}
+
+		profile, ok := values["profile"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if !sessionMatches(profile, sub, sid) {
+			continue
+		}
+
+		if e := os.Remove(filename); e != nil && !os.IsNotExist(e) {
+			err = e
+			return
+		}
+		removed++
+	}
+
+	return
+}
+
+// sessionMatches reports whether a stored profile belongs to the logout
+// target. When a sid is supplied only that session matches, otherwise every
+// session of the subject does.
+func sessionMatches(profile map[string]interface{}, sub string, sid string) bool {
+	sessionSub, _ := profile["sub"].(string)
+	if len(sub) > 0 && !strings.EqualFold(sessionSub, sub) {
+		return false
+	}
+	if len(sid) > 0 {
+		sessionSid, _ := profile["sid"].(string)
+		return sessionSid == sid
+	}
+	return true
+}
@@ -0,0 +1,35 @@
+package utilities
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// detachedContext is cancelled with its parent but carries none of its
+// values.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) { return c.parent.Deadline() }
+func (c detachedContext) Done() <-chan struct{}       { return c.parent.Done() }
+func (c detachedContext) Err() error                  { return c.parent.Err() }
+func (c detachedContext) Value(key interface{}) interface{} {
+	return nil
+}
+
+// SubRequestContext returns the context for a sub-request of r, e.g. one of
+// a batch. It is cancelled with r and carries its request id, CSP nonce and
+// upstream pool, but not its gorilla session registry, which is not safe for
+// concurrent use. Sub-requests load their own session from the cookies.
+func SubRequestContext(r *http.Request) context.Context {
+	parent := r.Context()
+	ctx := context.Context(detachedContext{parent})
+	for _, key := range []interface{}{requestIdKey{}, cspNonceKey{}, upstreamContextKey{}} {
+		if value := parent.Value(key); value != nil {
+			ctx = context.WithValue(ctx, key, value)
+		}
+	}
+	return ctx
+}
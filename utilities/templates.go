@@ -0,0 +1,237 @@
+package utilities
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"github.com/golang/glog"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	layoutTemplate    = "layout.html"
+	partialsDirectory = "partials"
+	pagesDirectory    = "pages"
+)
+
+// PageData is passed to every page template. The session and status fields
+// are filled in by RenderPage, Data holds anything specific to the page.
+// Entry names the page of the frontend build, e.g. ddr/ddr.html, whose
+// scripts and stylesheets are included.
+type PageData struct {
+	Title    string
+	Game     string
+	Entry    string
+	LoggedIn bool
+	User     *bst_models.UserCache
+	Status   bst_models.ApiStatus
+	Dev      bool
+	Nonce    string
+	Data     interface{}
+}
+
+// pageEntry lists the assets a page of the frontend build includes.
+type pageEntry struct {
+	scripts     []string
+	stylesheets []string
+}
+
+var (
+	pageTemplates     map[string]*template.Template
+	pageEntries       map[string]pageEntry
+	pageTemplatesLock sync.RWMutex
+
+	// PageStatus reports the current api status shown on every page.
+	PageStatus func(ctx context.Context) bst_models.ApiStatus
+
+	scriptPattern     = regexp.MustCompile(`(?is)<script\b[^>]*?\bsrc\s*=\s*["']?([^"'\s>]+)`)
+	linkPattern       = regexp.MustCompile(`(?is)<link\b[^>]*>`)
+	stylesheetPattern = regexp.MustCompile(`(?i)\brel\s*=\s*["']?stylesheet\b`)
+	hrefPattern       = regexp.MustCompile(`(?i)\bhref\s*=\s*["']?([^"'\s>]+)`)
+
+	templateFuncs = template.FuncMap{
+		"scripts":     entryScripts,
+		"stylesheets": entryStylesheets,
+		"percent": func(v float64) string {
+			return fmt.Sprintf("%.2f%%", v)
+		},
+		"time": formatTemplateTime,
+	}
+)
+
+// LoadTemplates parses the layout, partials and pages of TemplateFiles. Every page is parsed once into its own copy of the
+// layout, so pages may each define the title, head, content and scripts
+// blocks. In dev mode the templates are parsed again whenever they change.
+// The assets of the built pages are read as well, so it must run after
+// BuildAssetManifest.
+func LoadTemplates() error {
+	layout, err := template.New(layoutTemplate).Funcs(templateFuncs).ParseFS(TemplateFiles, layoutTemplate)
+	if err != nil {
+		return err
+	}
+	if _, err = layout.ParseFS(TemplateFiles, path.Join(partialsDirectory, "*.html")); err != nil {
+		return err
+	}
+
+	pages, err := fs.Glob(TemplateFiles, path.Join(pagesDirectory, "*.html"))
+	if err != nil {
+		return err
+	}
+
+	parsed := make(map[string]*template.Template)
+	for _, page := range pages {
+		t, err := layout.Clone()
+		if err != nil {
+			return err
+		}
+		if _, err = t.ParseFS(TemplateFiles, page); err != nil {
+			return err
+		}
+		parsed[strings.TrimSuffix(path.Base(page), ".html")] = t
+	}
+	pageTemplatesLock.Lock()
+	pageTemplates = parsed
+	pageTemplatesLock.Unlock()
+	glog.Infof("loaded %d page templates", len(parsed))
+	return loadPageEntries()
+}
+
+// loadPageEntries reads the scripts and stylesheets of every html page of
+// StaticFiles, which the layout includes for the page named by
+// PageData.Entry. In dev mode they are read again whenever the static files
+// change.
+func loadPageEntries() error {
+	entries := make(map[string]pageEntry)
+	err := fs.WalkDir(StaticFiles, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || path.Ext(name) != ".html" {
+			return err
+		}
+		page, err := fs.ReadFile(StaticFiles, name)
+		if err != nil {
+			return err
+		}
+		entries[name] = parsePageEntry(name, page)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pageTemplatesLock.Lock()
+	pageEntries = entries
+	pageTemplatesLock.Unlock()
+	return nil
+}
+
+// RenderPage writes the named page with the given status code. The page is
+// rendered to a buffer first, so a failing template results in a plain 500
+// rather than half a page.
+func RenderPage(rw http.ResponseWriter, r *http.Request, status int, page string, data PageData) {
+	pageTemplatesLock.RLock()
+	t, ok := pageTemplates[page]
+	pageTemplatesLock.RUnlock()
+	if !ok {
+		glog.Errorf("page template %s not found", page)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fillPageData(r, &data)
+	var buffer bytes.Buffer
+	if err := t.ExecuteTemplate(&buffer, layoutTemplate, data); err != nil {
+		glog.Errorf("failed to render page %s: %v", page, err)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(status)
+	rw.Write(buffer.Bytes())
+}
+
+func fillPageData(r *http.Request, data *PageData) {
+	if sub := SubForRequest(r); len(sub) > 0 {
+		data.LoggedIn = true
+		if userCache, ok := GetCacheValue("users", UserCacheKey(r.Context(), sub)).(bst_models.UserCache); ok {
+			data.User = &userCache
+		}
+	}
+	data.Dev = DevMode
+	data.Nonce = CspNonce(r)
+	if PageStatus != nil {
+		data.Status = PageStatus(r.Context())
+	}
+}
+
+func formatTemplateTime(t interface{}) string {
+	switch v := t.(type) {
+	case time.Time:
+		return v.UTC().Format("2006-01-02 15:04 MST")
+	case *time.Time:
+		return v.UTC().Format("2006-01-02 15:04 MST")
+	}
+	return ""
+}
+
+// parsePageEntry collects the urls of the scripts loaded and stylesheets
+// linked by the built page.
+func parsePageEntry(name string, page []byte) (entry pageEntry) {
+	for _, match := range scriptPattern.FindAllSubmatch(page, -1) {
+		entry.scripts = append(entry.scripts, entryAssetUrl(name, string(match[1])))
+	}
+	for _, link := range linkPattern.FindAll(page, -1) {
+		if !stylesheetPattern.Match(link) {
+			continue
+		}
+		if match := hrefPattern.FindSubmatch(link); match != nil {
+			entry.stylesheets = append(entry.stylesheets, entryAssetUrl(name, string(match[1])))
+		}
+	}
+	return
+}
+
+// lookupPageEntry returns the assets of the built page named entry.
+func lookupPageEntry(entry string) pageEntry {
+	pageTemplatesLock.RLock()
+	defer pageTemplatesLock.RUnlock()
+	return pageEntries[strings.TrimPrefix(path.Clean("/"+entry), "/")]
+}
+
+// entryScripts returns the urls of the scripts loaded by the built page
+// entry.
+func entryScripts(entry string) []string {
+	if len(entry) == 0 {
+		return nil
+	}
+	return lookupPageEntry(entry).scripts
+}
+
+// entryStylesheets returns the urls of the stylesheets linked by the built
+// page entry. Pages without an entry of their own use those of the index
+// page.
+func entryStylesheets(entry string) []string {
+	if len(entry) == 0 {
+		entry = IndexPage
+	}
+	return lookupPageEntry(entry).stylesheets
+}
+
+// entryAssetUrl resolves ref relative to the entry, preferring the content
+// hash url of local assets.
+func entryAssetUrl(entry string, ref string) string {
+	if strings.HasPrefix(ref, "//") || strings.Contains(ref, "://") {
+		return ref
+	}
+	if !strings.HasPrefix(ref, "/") {
+		ref = path.Join(path.Dir("/"+entry), ref)
+	}
+	return AssetUrl(path.Clean(ref))
+}
@@ -0,0 +1,271 @@
+package utilities
+
+import (
+	"fmt"
+	bst_models "github.com/chris-sg/bst_server_models"
+	"github.com/golang/glog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleLimit describes how many failed attempts are tolerated for a key
+// before attempts are delayed, and when it is locked out entirely.
+type throttleLimit struct {
+	Name         string
+	FreeAttempts int
+	MaxAttempts  int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Lockout      time.Duration
+	Window       time.Duration
+}
+
+type throttleEntry struct {
+	failures    int
+	lastFailure time.Time
+	nextAllowed time.Time
+	lockedUntil time.Time
+	inFlight    int
+}
+
+type throttle struct {
+	sync.Mutex
+	limit   throttleLimit
+	entries map[string]*throttleEntry
+}
+
+var (
+	eagateUserThrottle = newThrottle(throttleLimit{
+		Name:         "user",
+		FreeAttempts: 3,
+		MaxAttempts:  10,
+		BaseDelay:    2 * time.Second,
+		MaxDelay:     2 * time.Minute,
+		Lockout:      15 * time.Minute,
+		Window:       time.Hour,
+	})
+	eagateIpThrottle = newThrottle(throttleLimit{
+		Name:         "ip",
+		FreeAttempts: 5,
+		MaxAttempts:  20,
+		BaseDelay:    2 * time.Second,
+		MaxDelay:     2 * time.Minute,
+		Lockout:      30 * time.Minute,
+		Window:       time.Hour,
+	})
+	eagateTargetThrottle = newThrottle(throttleLimit{
+		Name:         "eagate account",
+		FreeAttempts: 2,
+		MaxAttempts:  5,
+		BaseDelay:    5 * time.Second,
+		MaxDelay:     5 * time.Minute,
+		Lockout:      time.Hour,
+		Window:       6 * time.Hour,
+	})
+)
+
+func newThrottle(limit throttleLimit) *throttle {
+	return &throttle{
+		limit:   limit,
+		entries: make(map[string]*throttleEntry),
+	}
+}
+
+// reserve returns how long the caller has to wait before the next attempt
+// for key is allowed, and whether the key is locked out. When the attempt is
+// allowed it is counted as in flight until released, so concurrent attempts
+// cannot all pass before the first failure is recorded. Attempts within the
+// free ones may run concurrently, later ones only one at a time.
+func (t *throttle) reserve(key string, now time.Time) (wait time.Duration, locked bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	entry := t.entry(key, now)
+	if entry == nil {
+		entry = &throttleEntry{}
+		t.entries[key] = entry
+	}
+	if now.Before(entry.lockedUntil) {
+		return entry.lockedUntil.Sub(now), true
+	}
+	if now.Before(entry.nextAllowed) {
+		return entry.nextAllowed.Sub(now), false
+	}
+	if entry.inFlight > 0 && entry.failures+entry.inFlight >= t.limit.FreeAttempts {
+		return t.limit.BaseDelay, false
+	}
+	entry.inFlight++
+	return
+}
+
+// release settles an attempt reserved for key.
+func (t *throttle) release(key string) {
+	t.Lock()
+	defer t.Unlock()
+	if entry, ok := t.entries[key]; ok && entry.inFlight > 0 {
+		entry.inFlight--
+	}
+}
+
+// fail records a failed attempt for key and reports whether this failure
+// caused a lockout.
+func (t *throttle) fail(key string, now time.Time) (lockedOut bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	entry := t.entry(key, now)
+	if entry == nil {
+		entry = &throttleEntry{}
+		t.entries[key] = entry
+	}
+
+	entry.failures++
+	entry.lastFailure = now
+
+	if entry.failures >= t.limit.MaxAttempts {
+		entry.lockedUntil = now.Add(t.limit.Lockout)
+		entry.failures = 0
+		return true
+	}
+
+	if entry.failures > t.limit.FreeAttempts {
+		delay := t.limit.BaseDelay << uint(entry.failures-t.limit.FreeAttempts-1)
+		if delay > t.limit.MaxDelay || delay <= 0 {
+			delay = t.limit.MaxDelay
+		}
+		entry.nextAllowed = now.Add(delay)
+	}
+	return false
+}
+
+func (t *throttle) reset(key string) {
+	t.Lock()
+	defer t.Unlock()
+	if entry, ok := t.entries[key]; ok && entry.inFlight > 0 {
+		*entry = throttleEntry{inFlight: entry.inFlight}
+		return
+	}
+	delete(t.entries, key)
+}
+
+// entry returns the state for key, dropping it when it has gone stale and no
+// attempt is in flight. Callers must hold the lock.
+func (t *throttle) entry(key string, now time.Time) *throttleEntry {
+	entry, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.inFlight == 0 && now.After(entry.lockedUntil) && now.Sub(entry.lastFailure) > t.limit.Window {
+		delete(t.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// sweep drops all stale entries.
+func (t *throttle) sweep(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	for key := range t.entries {
+		t.entry(key, now)
+	}
+}
+
+// StartThrottleJanitor periodically removes stale throttle state.
+func StartThrottleJanitor(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			now := time.Now()
+			eagateUserThrottle.sweep(now)
+			eagateIpThrottle.sweep(now)
+			eagateTargetThrottle.sweep(now)
+		}
+	}()
+}
+
+type eagateAttempt struct {
+	throttle *throttle
+	key      string
+}
+
+func eagateAttempts(sub string, ip string, target string) []eagateAttempt {
+	return []eagateAttempt{
+		{eagateUserThrottle, strings.ToLower(sub)},
+		{eagateIpThrottle, ip},
+		{eagateTargetThrottle, strings.ToLower(target)},
+	}
+}
+
+// ReserveEagateLogin determines whether an eagate login for the target
+// account may be forwarded on behalf of the user and, if so, reserves the
+// attempt. A reserved attempt must be settled with RecordEagateLogin or
+// ReleaseEagateLogin. When it may not, the returned error describes the
+// reason and retryAfter how long the caller has to wait.
+func ReserveEagateLogin(sub string, ip string, target string) (retryAfter time.Duration, err bst_models.Error) {
+	err = bst_models.ErrorOK
+	now := time.Now()
+
+	attempts := eagateAttempts(sub, ip, target)
+	for i, attempt := range attempts {
+		wait, locked := attempt.throttle.reserve(attempt.key, now)
+		if wait == 0 {
+			continue
+		}
+		for _, reserved := range attempts[:i] {
+			reserved.throttle.release(reserved.key)
+		}
+
+		retryAfter = wait
+		if locked {
+			err = ErrorEagateLocked
+		} else {
+			err = ErrorEagateThrottled
+		}
+		err.Message = fmt.Sprintf("%s for this %s, retry in %s", err.Message, attempt.throttle.limit.Name, roundUp(wait))
+		return
+	}
+
+	return
+}
+
+// RecordEagateLogin settles a reserved attempt with the outcome of the
+// eagate login. Lockouts are written to the audit log.
+func RecordEagateLogin(r *http.Request, sub string, target string, success bool) {
+	attempts := eagateAttempts(sub, ClientIp(r), target)
+	for _, attempt := range attempts {
+		attempt.throttle.release(attempt.key)
+	}
+
+	if success {
+		for _, attempt := range attempts {
+			if attempt.throttle != eagateIpThrottle {
+				attempt.throttle.reset(attempt.key)
+			}
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, attempt := range attempts {
+		if attempt.throttle.fail(attempt.key, now) {
+			reason := fmt.Sprintf("%s %s locked for %s after repeated failed logins to eagate user %s",
+				attempt.throttle.limit.Name, attempt.key, attempt.throttle.limit.Lockout, target)
+			glog.Warning(reason)
+			AuditSub(r, sub, AuditEagateLockout, AuditFailure, reason)
+		}
+	}
+}
+
+// ReleaseEagateLogin settles a reserved attempt whose outcome is unknown,
+// e.g. because the BST API failed, without counting it.
+func ReleaseEagateLogin(r *http.Request, sub string, target string) {
+	for _, attempt := range eagateAttempts(sub, ClientIp(r), target) {
+		attempt.throttle.release(attempt.key)
+	}
+}
+
+func roundUp(d time.Duration) time.Duration {
+	return (d + time.Second - 1).Truncate(time.Second)
+}
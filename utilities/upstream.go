@@ -0,0 +1,374 @@
+package utilities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream selection strategies.
+const (
+	UpstreamRoundRobin = "roundrobin"
+	UpstreamFailover   = "failover"
+)
+
+const (
+	// bstApiHost is the logical host of BST API urls. The upstream transport
+	// replaces it with the selected upstream.
+	bstApiHost = "bst-api"
+
+	upstreamEjectAfter  = 3
+	upstreamEjectPeriod = 30 * time.Second
+	upstreamMaxEject    = 5 * time.Minute
+)
+
+var (
+	upstreams *UpstreamPool
+)
+
+// Upstream is a single BST API host.
+type Upstream struct {
+	Host   string
+	Weight int
+
+	healthy             bool
+	lastCheck           time.Time
+	lastCheckError      string
+	consecutiveFailures int
+	ejections           int
+	ejectedUntil        time.Time
+	currentWeight       int
+
+	requests     int64
+	failures     int64
+	totalLatency time.Duration
+}
+
+// UpstreamStats are the counters reported for an upstream.
+type UpstreamStats struct {
+	Host                string     `json:"host"`
+	Weight              int        `json:"weight"`
+	Healthy             bool       `json:"healthy"`
+	Ejected             bool       `json:"ejected"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+	LastCheck           time.Time  `json:"last_check"`
+	LastCheckError      string     `json:"last_check_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Ejections           int        `json:"ejections"`
+	Requests            int64      `json:"requests"`
+	Failures            int64      `json:"failures"`
+	AverageLatencyMs    float64    `json:"average_latency_ms"`
+}
+
+// UpstreamPool selects among BST API hosts, skipping unhealthy and ejected
+// ones.
+type UpstreamPool struct {
+	sync.Mutex
+	name      string
+	strategy  string
+	upstreams []*Upstream
+}
+
+// ParseUpstreams parses a comma separated list of host[=weight] entries.
+func ParseUpstreams(spec string) ([]*Upstream, error) {
+	result := make([]*Upstream, 0)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		upstream := &Upstream{
+			Host:    entry,
+			Weight:  1,
+			healthy: true,
+		}
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			weight, err := strconv.Atoi(entry[i+1:])
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid weight in upstream %q", entry)
+			}
+			upstream.Host = entry[:i]
+			upstream.Weight = weight
+		}
+		result = append(result, upstream)
+	}
+	return result, nil
+}
+
+// NewUpstreamPool creates a pool for the given hosts.
+func NewUpstreamPool(name string, spec string, strategy string) (*UpstreamPool, error) {
+	if strategy != UpstreamRoundRobin && strategy != UpstreamFailover {
+		return nil, fmt.Errorf("unknown upstream strategy %q", strategy)
+	}
+	list, err := ParseUpstreams(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no upstreams configured for %s", name)
+	}
+	return &UpstreamPool{
+		name:      name,
+		strategy:  strategy,
+		upstreams: list,
+	}, nil
+}
+
+// InitUpstreams creates the BST API upstream pool from the `api` flags and
+// starts its health checks.
+func InitUpstreams() (err error) {
+	upstreams, err = NewUpstreamPool("primary", bstApiHosts, upstreamStrategy)
+	if err != nil {
+		return
+	}
+	upstreams.StartHealthChecks(upstreamCheckInterval)
+	return
+}
+
+// BstApiUrl returns the url of path on the BST API. The host is resolved to a
+// concrete upstream when the request is sent with GetClient().
+func BstApiUrl(path string) *url.URL {
+	return &url.URL{
+		Scheme: "https",
+		Host:   bstApiHost,
+		Path:   BstApiBase + path,
+	}
+}
+
+// Next returns the upstream the next request should be sent to, excluding
+// the given hosts where possible.
+func (p *UpstreamPool) Next(exclude map[string]bool) *Upstream {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	candidates := make([]*Upstream, 0, len(p.upstreams))
+	for _, upstream := range p.upstreams {
+		if upstream.healthy && now.After(upstream.ejectedUntil) && !exclude[upstream.Host] {
+			candidates = append(candidates, upstream)
+		}
+	}
+	if len(candidates) == 0 {
+		// everything is failing, keep trying rather than refusing outright
+		for _, upstream := range p.upstreams {
+			if !exclude[upstream.Host] {
+				candidates = append(candidates, upstream)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if p.strategy == UpstreamFailover {
+		return candidates[0]
+	}
+
+	// smooth weighted round robin
+	total := 0
+	var best *Upstream
+	for _, upstream := range candidates {
+		upstream.currentWeight += upstream.Weight
+		total += upstream.Weight
+		if best == nil || upstream.currentWeight > best.currentWeight {
+			best = upstream
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// Report records the outcome of a request sent to upstream. Repeated
+// failures eject the upstream for a growing period.
+func (p *UpstreamPool) Report(upstream *Upstream, latency time.Duration, failed bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	upstream.requests++
+	upstream.totalLatency += latency
+	if !failed {
+		upstream.consecutiveFailures = 0
+		return
+	}
+
+	upstream.failures++
+	upstream.consecutiveFailures++
+	if upstream.consecutiveFailures >= upstreamEjectAfter && time.Now().After(upstream.ejectedUntil) {
+		period := upstreamEjectPeriod << uint(upstream.ejections)
+		if period > upstreamMaxEject || period <= 0 {
+			period = upstreamMaxEject
+		}
+		upstream.ejections++
+		upstream.ejectedUntil = time.Now().Add(period)
+		upstream.consecutiveFailures = 0
+		glog.Warningf("ejecting %s upstream %s for %s", p.name, upstream.Host, period)
+	}
+}
+
+// StartHealthChecks polls the status endpoint of every upstream.
+func (p *UpstreamPool) StartHealthChecks(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			for _, upstream := range p.upstreams {
+				p.check(upstream)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (p *UpstreamPool) check(upstream *Upstream) {
+	uri := &url.URL{
+		Scheme: "https",
+		Host:   upstream.Host,
+		Path:   BstApiBase + "status",
+	}
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    uri,
+		Header: make(http.Header),
+	}
+
+	var err error
+	res, e := GetClient().Do(req)
+	if e != nil {
+		err = e
+	} else {
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			err = errors.New("status returned " + res.Status)
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	wasHealthy := upstream.healthy
+	upstream.healthy = err == nil
+	upstream.lastCheck = time.Now()
+	upstream.lastCheckError = ""
+	if err != nil {
+		upstream.lastCheckError = err.Error()
+	} else {
+		upstream.ejections = 0
+	}
+	if wasHealthy != upstream.healthy {
+		glog.Warningf("%s upstream %s healthy: %t %s", p.name, upstream.Host, upstream.healthy, upstream.lastCheckError)
+	}
+}
+
+// Stats returns the counters of every upstream in declaration order.
+func (p *UpstreamPool) Stats() []UpstreamStats {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	stats := make([]UpstreamStats, 0, len(p.upstreams))
+	for _, upstream := range p.upstreams {
+		s := UpstreamStats{
+			Host:                upstream.Host,
+			Weight:              upstream.Weight,
+			Healthy:             upstream.healthy,
+			Ejected:             now.Before(upstream.ejectedUntil),
+			LastCheck:           upstream.lastCheck,
+			LastCheckError:      upstream.lastCheckError,
+			ConsecutiveFailures: upstream.consecutiveFailures,
+			Ejections:           upstream.ejections,
+			Requests:            upstream.requests,
+			Failures:            upstream.failures,
+		}
+		if s.Ejected {
+			until := upstream.ejectedUntil
+			s.EjectedUntil = &until
+		}
+		if upstream.requests > 0 {
+			s.AverageLatencyMs = float64(upstream.totalLatency/time.Millisecond) / float64(upstream.requests)
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// UpstreamStatistics returns the counters of the BST API upstreams.
+func UpstreamStatistics() []UpstreamStats {
+	if upstreams == nil {
+		return []UpstreamStats{}
+	}
+	return upstreams.Stats()
+}
+
+// upstreamTransport resolves the logical BST API host to an upstream of the
+// default pool, or the pool chosen for the request by CanaryRouting. Idempotent
+// requests are retried once on another upstream when the
+// first one fails to answer.
+type upstreamTransport struct {
+	next http.RoundTripper
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pool := upstreamPoolFor(req.Context())
+	if req.URL.Host != bstApiHost || pool == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	attempts := 1
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		attempts = 2
+	}
+
+	tried := make(map[string]bool)
+	var res *http.Response
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		upstream := pool.Next(tried)
+		if upstream == nil {
+			break
+		}
+		tried[upstream.Host] = true
+
+		outgoing := req.Clone(req.Context())
+		outgoing.URL.Host = upstream.Host
+		outgoing.Host = ""
+
+		start := time.Now()
+		res, err = t.next.RoundTrip(outgoing)
+		latency := time.Since(start)
+		pool.Report(upstream, latency, upstreamFailed(req, res, err))
+		if err == nil {
+			glog.V(2).Infof("%s %s via %s upstream %s: %d in %s", req.Method, req.URL.Path, pool.name, upstream.Host, res.StatusCode, latency)
+			return res, nil
+		}
+		glog.Warningf("%s upstream %s failed: %v", pool.name, upstream.Host, err)
+	}
+
+	if err == nil {
+		err = errors.New("no bst api upstream available")
+	}
+	return nil, err
+}
+
+// upstreamFailed reports whether a round trip counts against the health of
+// the upstream: transport errors and timeouts, and the gateway statuses a
+// proxy in front of an unavailable host answers with. Other 5xx statuses are
+// application errors, e.g. for a bad eagate login, and do not count, nor do
+// requests cancelled by the client.
+func upstreamFailed(req *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() != context.Canceled
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}